@@ -7,12 +7,16 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"syscall"
 	"time"
 
 	"imageapp/internal/handlers"
 	mw "imageapp/internal/middleware"
 	"imageapp/internal/services"
+	"imageapp/internal/storage"
 	"imageapp/internal/ws"
 
 	"github.com/go-chi/chi/v5"
@@ -23,10 +27,6 @@ import (
 func main() {
 	ctx := context.Background()
 
-	// Storage
-	os.MkdirAll("./storage", 0o755)
-	os.MkdirAll("./storage/thumbnails", 0o755)
-
 	// Database
 	dbPool, err := pgxpool.New(ctx, os.Getenv("DATABASE_URL"))
 	if err != nil {
@@ -34,19 +34,140 @@ func main() {
 	}
 	defer dbPool.Close()
 
-	if err := migrate(ctx, dbPool); err != nil {
+	if err := services.Migrate(ctx, dbPool); err != nil {
 		log.Fatalf("migrate: %v", err)
 	}
 
-	// Embedding Service
-	embedder, err := services.NewEmbeddingService(
-		"./model/model.onnx",
-		"./model/tokenizer.json",
+	// Blob storage
+	store, err := newStorage(ctx)
+	if err != nil {
+		log.Fatalf("storage: %v", err)
+	}
+
+	// Embedding models: EMBEDDING_MODEL is served, NEXT_EMBEDDING_MODEL is
+	// backfilled in the background and replaces it once complete
+	current, err := newEmbeddingModel(
+		envString("EMBEDDING_MODEL", "all-MiniLM-L6-v2"),
+		envString("EMBEDDING_MODEL_DIR", "./model"),
 	)
 	if err != nil {
 		log.Fatalf("embedding service: %v", err)
 	}
-	defer embedder.Close()
+	defer current.Embedder.Close()
+
+	var next *services.EmbeddingModel
+	if name := os.Getenv("NEXT_EMBEDDING_MODEL"); name != "" {
+		m, err := newEmbeddingModel(name, envString("NEXT_EMBEDDING_MODEL_DIR", filepath.Join("./model", name)))
+		if err != nil {
+			log.Fatalf("next embedding service: %v", err)
+		}
+		defer m.Embedder.Close()
+		next = &m
+	}
+
+	// which text of an image is embedded: tags, title, concat or weighted
+	composer, err := services.NewTextComposer(
+		envString("EMBED_TEXT", "tags"),
+		envFloat("EMBED_TITLE_WEIGHT", 0.5),
+	)
+	if err != nil {
+		log.Fatalf("embed text: %v", err)
+	}
+
+	embeddingModels, err := services.NewModelSet(ctx, dbPool, current, next, composer)
+	if err != nil {
+		log.Fatalf("embedding models: %v", err)
+	}
+
+	// "server backfill" re-embeds all images with the configured
+	// composition and exits
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		n, err := services.Backfill(ctx, dbPool, embeddingModels, envInt("REEMBED_BATCH_SIZE", 64))
+		if err != nil {
+			log.Fatalf("backfill: %v", err)
+		}
+		log.Printf("Backfill done, %d images re-embedded", n)
+		return
+	}
+	reembedder := services.NewReembedder(dbPool, embeddingModels, envInt("REEMBED_BATCH_SIZE", 64))
+
+	// CLIP model for visual search, optional
+	clip, err := newClipService(envString("CLIP_MODEL_DIR", "./model/clip"))
+	if err != nil {
+		log.Fatalf("clip service: %v", err)
+	}
+	if clip != nil {
+		defer clip.Close()
+	} else {
+		log.Println("CLIP model not found, visual search disabled")
+	}
+
+	// "server backfill-visual" computes the missing content embeddings,
+	// e.g. after CLIP was added, and exits
+	if len(os.Args) > 1 && os.Args[1] == "backfill-visual" {
+		if clip == nil {
+			log.Fatal("backfill-visual: no CLIP model")
+		}
+		n, err := services.BackfillVisual(ctx, dbPool, store, clip,
+			envInt("MAX_IMAGE_PIXELS", services.DefaultMaxPixels), envInt("REEMBED_BATCH_SIZE", 64))
+		if err != nil {
+			log.Fatalf("backfill-visual: %v", err)
+		}
+		log.Printf("Visual backfill done, %d images embedded", n)
+		return
+	}
+
+	// Cross-encoder for rerank=true searches, optional
+	reranker, err := newReranker(envString("RERANKER_MODEL_DIR", "./model/reranker"))
+	if err != nil {
+		log.Fatalf("reranker: %v", err)
+	}
+	if reranker != nil {
+		defer reranker.Close()
+	}
+
+	// Tag suggestions from AUTOTAG_VOCABULARY, one label per line; needs CLIP
+	var tagger *services.AutoTagger
+	if path := os.Getenv("AUTOTAG_VOCABULARY"); path != "" && clip != nil {
+		tagger, err = services.NewAutoTagger(
+			clip,
+			path,
+			envInt("AUTOTAG_TOP_K", 5),
+			envFloat("AUTOTAG_MIN_CONFIDENCE", 0.1),
+		)
+		if err != nil {
+			log.Fatalf("auto-tagger: %v", err)
+		}
+	}
+
+	maxPixels := envInt("MAX_IMAGE_PIXELS", services.DefaultMaxPixels)
+
+	renditions := services.DefaultRenditions
+	if spec := os.Getenv("RENDITIONS"); spec != "" {
+		if renditions, err = services.ParseRenditions(spec); err != nil {
+			log.Fatalf("renditions: %v", err)
+		}
+	}
+	// the thumbnail is one of the renditions, not a copy of its own
+	thumbnail := envString("THUMBNAIL_RENDITION", "sq512")
+	if !slices.ContainsFunc(renditions, func(r services.Rendition) bool { return r.Name == thumbnail }) {
+		log.Fatalf("thumbnail rendition %q is not in RENDITIONS", thumbnail)
+	}
+
+	// nil pointers would make non-nil interfaces, and the handlers check
+	// for nil to tell whether a model is configured
+	var visual services.VisualEncoder
+	if clip != nil {
+		visual = clip
+	}
+	var cross services.CrossEncoder
+	if reranker != nil {
+		cross = reranker
+	}
+	var suggester services.Tagger
+	if tagger != nil {
+		suggester = tagger
+	}
 
 	// WebSocket Hub
 	hub := ws.NewHub()
@@ -55,27 +176,83 @@ func main() {
 	// Image Processor (thumbnail + embedding)
 	processor := services.NewImageProcessor(
 		dbPool,
-		"./storage",
-		3, // 3 workers at the moment ...
-		embedder,
+		store,
+		services.ProcessorConfig{
+			Workers:      envInt("PROCESSOR_WORKERS", 3),
+			PollInterval: envDuration("QUEUE_POLL_INTERVAL", 2*time.Second),
+			Lease:        envDuration("QUEUE_LEASE", 5*time.Minute),
+			MaxAttempts:  envInt("JOB_MAX_ATTEMPTS", 5),
+			BackoffBase:  envDuration("JOB_BACKOFF_BASE", 10*time.Second),
+			BackoffMax:   envDuration("JOB_BACKOFF_MAX", 30*time.Minute),
+			Renditions:   renditions,
+			Thumbnail:    thumbnail,
+			MaxPixels:    maxPixels,
+			BatchSize:    envInt("EMBED_BATCH_SIZE", 8),
+			BatchWindow:  envDuration("EMBED_BATCH_WINDOW", 5*time.Millisecond),
+		},
+		embeddingModels,
+		visual,
+		suggester,
 		func(job services.ImageJob) {
 			hub.Broadcast(ws.Message{
 				Type:         "thumbnail_ready",
 				ID:           job.FileID,
 				Title:        job.Title,
 				Tags:         job.Tags,
-				ThumbnailURL: fmt.Sprintf("/thumbnails/%d", job.FileID),
+				ThumbnailURL: store.URL(services.RenditionKey(job.FileID, thumbnail)),
 			})
 		},
 	)
 	defer processor.Shutdown()
 
-	// Process any pending images from previous run
-	go processPending(ctx, dbPool, processor)
+	// STRIP_LOCATION=true hides GPS data from served originals and the API
+	stripLocation := os.Getenv("STRIP_LOCATION") == "true"
+	if stripLocation && os.Getenv("STORAGE_BACKEND") == "s3" && os.Getenv("S3_PUBLIC_URL") != "" {
+		// clients would download originals from the bucket, past /uploads
+		log.Fatal("STRIP_LOCATION cannot be combined with S3_PUBLIC_URL")
+	}
 
 	// Handlers
-	uploadHandler := handlers.NewUploadHandler(dbPool, processor)
-	feedHandler := handlers.NewFeedHandler(dbPool, embedder)
+	uploadHandler := handlers.NewUploadHandler(dbPool, store, processor, maxPixels)
+	tusHandler, err := handlers.NewTusHandler(
+		envString("TUS_DIR", filepath.Join(os.TempDir(), "imageapp-tus")),
+		"/api/tus",
+		uploadHandler,
+	)
+	if err != nil {
+		log.Fatalf("tus: %v", err)
+	}
+	go purgeExpiredUploads(tusHandler)
+	// embeddings of recent search queries, shared by all pages of a search
+	queryCache := services.NewQueryCache(envInt("QUERY_CACHE_SIZE", 1024))
+	feedHandler := handlers.NewFeedHandler(dbPool, store, embeddingModels, visual, queryCache, cross, handlers.FeedConfig{
+		VisualMinScore:         envFloat("VISUAL_MIN_SCORE", 0.2),
+		NegativeMinScore:       envFloat("NEGATIVE_MIN_SCORE", 0.5),
+		VisualNegativeMinScore: envFloat("VISUAL_NEGATIVE_MIN_SCORE", 0.25),
+		MaxPixels:              maxPixels,
+		CursorKey:              os.Getenv("CURSOR_SIGNING_KEY"),
+		RerankCandidates:       envInt("RERANK_CANDIDATES", 50),
+	})
+	renderPresets := renditions
+	if spec := os.Getenv("RENDER_PRESETS"); spec != "" {
+		if renderPresets, err = services.ParseRenditions(spec); err != nil {
+			log.Fatalf("render presets: %v", err)
+		}
+	}
+	renderHandler, err := handlers.NewRenderHandler(
+		dbPool,
+		store,
+		envString("RENDER_CACHE_DIR", "./cache/render"),
+		renderPresets,
+		os.Getenv("RENDER_SIGNING_KEY"),
+		maxPixels,
+	)
+	if err != nil {
+		log.Fatalf("render: %v", err)
+	}
+	go evictRenderCache(renderHandler, int64(envInt("RENDER_CACHE_MAX_MB", 1024))<<20)
+	imageHandler := handlers.NewImageHandler(dbPool, store, embeddingModels, hub, renderHandler, stripLocation)
+	adminHandler := handlers.NewAdminHandler(dbPool, processor, queryCache)
 
 	// Add three initial images if the database is empty:
 	go seedInitialImages(ctx, dbPool, uploadHandler)
@@ -83,18 +260,53 @@ func main() {
 	// Router
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
-	r.Use(mw.CorsMiddleware)
+	// the admin API is for operators, not for pages of other origins
+	r.Use(mw.CorsExcept("/api/admin"))
 
 	// Static files
-	r.Handle("/uploads/*", http.StripPrefix("/uploads/",
-		http.FileServer(http.Dir("./storage"))))
-	r.Handle("/thumbnails/*", http.StripPrefix("/thumbnails/",
-		http.FileServer(http.Dir("./storage/thumbnails"))))
+	if stripLocation {
+		r.Get("/uploads/*", handlers.LocationStrippedBlobHandler(store, ""))
+	} else {
+		r.Get("/uploads/*", handlers.BlobHandler(store, ""))
+	}
+	r.Get("/thumbnails/*", handlers.BlobHandler(store, "thumbnails/"))
 
 	// API
 	r.Route("/api", func(r chi.Router) {
 		r.Post("/upload", uploadHandler.Upload)
 		r.Get("/feed", feedHandler.Feed)
+		r.Post("/search/by-image", feedHandler.SearchByImage)
+
+		// resumable uploads (tus protocol)
+		r.Route("/tus", func(r chi.Router) {
+			r.Options("/", tusHandler.Options)
+			r.Post("/", tusHandler.Create)
+			r.Head("/{uploadID}", tusHandler.Head)
+			r.Patch("/{uploadID}", tusHandler.Patch)
+			r.Delete("/{uploadID}", tusHandler.Delete)
+		})
+
+		r.Route("/images/{id}", func(r chi.Router) {
+			r.Get("/", imageHandler.Get)
+			r.Patch("/", imageHandler.Update)
+			r.Delete("/", imageHandler.Delete)
+			r.Post("/suggested-tags", imageHandler.ReviewSuggestions)
+			r.Get("/render", renderHandler.Render)
+			r.Get("/similar", feedHandler.Similar)
+		})
+
+		// ADMIN_TOKEN guards the admin API; without it the API is off
+		if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+			r.Route("/admin", func(r chi.Router) {
+				r.Use(mw.AdminToken(token))
+				r.Get("/jobs/dead", adminHandler.DeadJobs)
+				r.Post("/jobs/{imageID}/requeue", adminHandler.RequeueJob)
+				r.Get("/embedding-models", adminHandler.EmbeddingModels)
+				r.Get("/query-cache", adminHandler.QueryCache)
+			})
+		} else {
+			log.Println("ADMIN_TOKEN not set, admin API disabled")
+		}
 	})
 
 	// WebSocket
@@ -126,62 +338,129 @@ func main() {
 
 	srv.Shutdown(shutdownCtx)
 	hub.Shutdown()
+	reembedder.Shutdown()
 	processor.Shutdown()
-	embedder.Close()
+	current.Embedder.Close()
+	if next != nil {
+		next.Embedder.Close()
+	}
+	if clip != nil {
+		clip.Close()
+	}
 	dbPool.Close()
 }
 
-func migrate(ctx context.Context, db *pgxpool.Pool) error {
-	_, err := db.Exec(ctx, `
-		CREATE EXTENSION IF NOT EXISTS vector;
-		CREATE TABLE IF NOT EXISTS images (
-			id                BIGSERIAL PRIMARY KEY,
-			title             TEXT NOT NULL,
-			tags              TEXT[] NOT NULL,
-			filename          TEXT NOT NULL,
-			size              BIGINT NOT NULL,
-			mime              TEXT NOT NULL,
-			checksum          TEXT NOT NULL UNIQUE,
-			storage_path      TEXT NOT NULL,
-			image_url         TEXT NOT NULL,
-			embedding         vector(384) NOT NULL,
-			thumbnail_path    TEXT,
-			thumbnail_status  TEXT NOT NULL DEFAULT 'pending',
-			created_at        TIMESTAMPTZ DEFAULT NOW()
-		);
-
-		CREATE INDEX IF NOT EXISTS images_embedding_idx 
-			ON images USING hnsw (embedding vector_cosine_ops);
-	`)
-	return err
+// newEmbeddingModel loads model.onnx and tokenizer.json from dir. With
+// EMBEDDER=fake no files are needed, the vectors are stored as model "fake".
+func newEmbeddingModel(name, dir string) (services.EmbeddingModel, error) {
+	if os.Getenv("EMBEDDER") == "fake" {
+		log.Println("Using fake embedder, tag search results are not semantic")
+		return services.EmbeddingModel{Name: "fake", Embedder: services.NewFakeEmbedder(services.EmbeddingDim)}, nil
+	}
+	embedder, err := services.NewEmbeddingService(
+		filepath.Join(dir, "model.onnx"),
+		filepath.Join(dir, "tokenizer.json"),
+		envInt("EMBEDDING_SESSIONS", 2),
+		envInt("EMBEDDING_MAX_TOKENS", 128),
+	)
+	if err != nil {
+		return services.EmbeddingModel{}, err
+	}
+	return services.EmbeddingModel{Name: name, Embedder: embedder}, nil
 }
 
-func processPending(ctx context.Context, db *pgxpool.Pool, processor *services.ImageProcessor) {
-	rows, err := db.Query(ctx, `
-		SELECT id, storage_path, filename, title, tags
-		FROM images 
-		WHERE thumbnail_status = 'pending'
-	`)
-	if err != nil {
-		log.Printf("Failed to get pending images: %v", err)
-		return
+// newClipService loads the CLIP encoders from dir. It returns nil without
+// an error if the model files are not there.
+func newClipService(dir string) (*services.ClipService, error) {
+	vision := filepath.Join(dir, "vision_model.onnx")
+	if _, err := os.Stat(vision); os.IsNotExist(err) {
+		return nil, nil
 	}
-	defer rows.Close()
+	return services.NewClipService(
+		vision,
+		filepath.Join(dir, "text_model.onnx"),
+		filepath.Join(dir, "tokenizer.json"),
+	)
+}
 
-	count := 0
-	for rows.Next() {
-		var job services.ImageJob
-		if err := rows.Scan(&job.FileID, &job.FilePath, &job.Filename, &job.Title, &job.Tags); err != nil {
-			log.Printf("Failed to scan pending image: %v", err)
-			continue
+// newReranker loads the cross-encoder from dir. It returns nil without an
+// error if the model files are not there.
+func newReranker(dir string) (*services.Reranker, error) {
+	model := filepath.Join(dir, "model.onnx")
+	if _, err := os.Stat(model); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return services.NewReranker(
+		model,
+		filepath.Join(dir, "tokenizer.json"),
+		envInt("RERANK_MAX_TOKENS", 256),
+	)
+}
+
+// purgeExpiredUploads drops tus uploads that were abandoned for a day.
+func purgeExpiredUploads(tusHandler *handlers.TusHandler) {
+	for {
+		tusHandler.PurgeExpired(24 * time.Hour)
+		time.Sleep(time.Hour)
+	}
+}
+
+// evictRenderCache keeps the render cache below maxBytes.
+func evictRenderCache(renderHandler *handlers.RenderHandler, maxBytes int64) {
+	for {
+		if err := renderHandler.Evict(maxBytes); err != nil {
+			log.Printf("render cache: %v", err)
 		}
-		processor.Queue(job)
-		count++
+		time.Sleep(10 * time.Minute)
 	}
+}
+
+// newStorage picks the blob backend from STORAGE_BACKEND ("local" or "s3").
+func newStorage(ctx context.Context) (storage.Storage, error) {
+	switch backend := envString("STORAGE_BACKEND", "local"); backend {
+	case "local":
+		return storage.NewLocal(envString("STORAGE_DIR", "./storage"), "/uploads")
+	case "s3":
+		return storage.NewS3(ctx, storage.S3Config{
+			Endpoint:  envString("S3_ENDPOINT", "localhost:9000"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    envString("S3_BUCKET", "imageapp"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			UseSSL:    os.Getenv("S3_USE_SSL") == "true",
+			PublicURL: os.Getenv("S3_PUBLIC_URL"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+func envFloat(key string, def float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return v
+	}
+	return def
+}
 
-	if count > 0 {
-		log.Printf("Queued %d pending images for processing", count)
+func envDuration(key string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil && v > 0 {
+		return v
 	}
+	return def
 }
 
 func seedInitialImages(ctx context.Context, dbPool *pgxpool.Pool, uploader *handlers.UploadHandler) {
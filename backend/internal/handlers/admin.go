@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"imageapp/internal/services"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+type DeadJob struct {
+	ImageID   int64     `json:"image_id"`
+	Title     string    `json:"title"`
+	Filename  string    `json:"filename"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// EmbeddingModelStatus is one text embedding model with its coverage:
+// Embedded of Total processed images have a vector from it.
+type EmbeddingModelStatus struct {
+	Name        string     `json:"name"`
+	Dim         int        `json:"dim"`
+	Status      string     `json:"status"` // building, active or retired
+	Embedded    int64      `json:"embedded"`
+	Total       int64      `json:"total"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ActivatedAt *time.Time `json:"activated_at,omitempty"`
+}
+
+type AdminHandler struct {
+	db             services.DB
+	imageProcessor JobWaker
+	queries        *services.QueryCache
+}
+
+func NewAdminHandler(db services.DB, processor JobWaker, queries *services.QueryCache) *AdminHandler {
+	return &AdminHandler{
+		db:             db,
+		imageProcessor: processor,
+		queries:        queries,
+	}
+}
+
+// DeadJobs lists jobs that used up all their attempts.
+func (h *AdminHandler) DeadJobs(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(r.Context(), `
+		SELECT j.image_id, i.title, i.filename, j.attempts,
+		       COALESCE(j.last_error, ''), j.updated_at
+		FROM image_jobs j
+		JOIN images i ON i.id = j.image_id
+		WHERE j.status = 'dead'
+		ORDER BY j.updated_at DESC
+	`)
+	if err != nil {
+		log.Printf("Dead jobs error: %v", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	jobs := []DeadJob{}
+	for rows.Next() {
+		var job DeadJob
+		if err := rows.Scan(&job.ImageID, &job.Title, &job.Filename,
+			&job.Attempts, &job.LastError, &job.UpdatedAt); err != nil {
+			log.Printf("Dead jobs error: %v", fmt.Errorf("scan: %w", err))
+			http.Error(w, "query failed", http.StatusInternalServerError)
+			return
+		}
+		jobs = append(jobs, job)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"items": jobs,
+	})
+}
+
+// RequeueJob puts a dead job back into the queue with a fresh attempt counter.
+func (h *AdminHandler) RequeueJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	imageID, err := strconv.ParseInt(chi.URLParam(r, "imageID"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid image id", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var status string
+	err = tx.QueryRow(ctx,
+		"SELECT status FROM image_jobs WHERE image_id = $1 FOR UPDATE", imageID,
+	).Scan(&status)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if status != "dead" {
+		http.Error(w, "no dead job for this image", http.StatusNotFound)
+		return
+	}
+
+	if err := services.EnqueueImageJob(ctx, tx, imageID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(ctx,
+		"UPDATE images SET thumbnail_status = 'pending' WHERE id = $1", imageID,
+	); err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	h.imageProcessor.Wake()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"image_id": imageID,
+		"status":   "queued",
+	})
+}
+
+// EmbeddingModels reports the known embedding models and the progress of a
+// running re-embed.
+func (h *AdminHandler) EmbeddingModels(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(r.Context(), `
+		SELECT m.name, m.dim, m.status, m.created_at, m.activated_at,
+		       CASE WHEN m.status = 'active'
+		            THEN (SELECT count(*) FROM images i WHERE i.embedding_model = m.name)
+		            ELSE (SELECT count(*) FROM image_embeddings e
+		                  JOIN images i ON i.id = e.image_id
+		                  WHERE e.model = m.name AND e.title = i.title AND e.tags = i.tags
+		                    AND i.embedding_model IS NOT NULL)
+		       END,
+		       (SELECT count(*) FROM images WHERE embedding_model IS NOT NULL)
+		FROM embedding_models m
+		ORDER BY m.created_at
+	`)
+	if err != nil {
+		log.Printf("Embedding models error: %v", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	models := []EmbeddingModelStatus{}
+	for rows.Next() {
+		var m EmbeddingModelStatus
+		if err := rows.Scan(&m.Name, &m.Dim, &m.Status, &m.CreatedAt,
+			&m.ActivatedAt, &m.Embedded, &m.Total); err != nil {
+			log.Printf("Embedding models error: %v", fmt.Errorf("scan: %w", err))
+			http.Error(w, "query failed", http.StatusInternalServerError)
+			return
+		}
+		models = append(models, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"items": models,
+	})
+}
+
+// QueryCache reports the hit and miss counters of the query embedding cache.
+func (h *AdminHandler) QueryCache(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.queries.Stats())
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"imageapp/internal/testdb"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// countingWaker counts how often the processor was woken.
+type countingWaker struct{ wakes int }
+
+func (w *countingWaker) Wake() { w.wakes++ }
+
+func TestRequeueJob(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.New(t)
+	waker := &countingWaker{}
+	h := NewAdminHandler(db, waker, nil)
+	r := chi.NewRouter()
+	r.Post("/api/admin/jobs/{imageID}/requeue", h.RequeueJob)
+
+	dead := insertImage(t, db, testImage{title: "dead", tags: []string{"x"}})
+	queued := insertImage(t, db, testImage{title: "queued", tags: []string{"y"}})
+	_, err := db.Exec(ctx, `
+		INSERT INTO image_jobs (image_id, status, attempts, last_error)
+		VALUES ($1, 'dead', 5, 'boom'), ($2, 'queued', 2, 'boom')
+	`, dead, queued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(ctx, "UPDATE images SET thumbnail_status = 'failed' WHERE id = $1", dead); err != nil {
+		t.Fatal(err)
+	}
+
+	requeue := func(id string) int {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/admin/jobs/"+id+"/requeue", nil))
+		return rec.Code
+	}
+
+	if code := requeue(itoa(dead)); code != http.StatusOK {
+		t.Fatalf("requeue dead job: status %d", code)
+	}
+	var status, thumbStatus string
+	var attempts int
+	var lastError *string
+	err = db.QueryRow(ctx, `
+		SELECT j.status, j.attempts, j.last_error, i.thumbnail_status
+		FROM image_jobs j JOIN images i ON i.id = j.image_id
+		WHERE j.image_id = $1
+	`, dead).Scan(&status, &attempts, &lastError, &thumbStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "queued" || attempts != 0 || lastError != nil || thumbStatus != "pending" {
+		t.Errorf("after requeue: job %s, %d attempts, last_error %v, image %s", status, attempts, lastError, thumbStatus)
+	}
+	if waker.wakes != 1 {
+		t.Errorf("processor woken %d times, want once", waker.wakes)
+	}
+
+	for _, tt := range []struct {
+		id   string
+		want int
+	}{
+		{itoa(queued), http.StatusNotFound},
+		{"999999", http.StatusNotFound},
+		{"abc", http.StatusBadRequest},
+	} {
+		if code := requeue(tt.id); code != tt.want {
+			t.Errorf("requeue %s: status %d, want %d", tt.id, code, tt.want)
+		}
+	}
+	if err := db.QueryRow(ctx, "SELECT attempts FROM image_jobs WHERE image_id = $1", queued).Scan(&attempts); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("a job that is not dead was reset to %d attempts", attempts)
+	}
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"imageapp/internal/services"
+	"imageapp/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/sync/singleflight"
+)
+
+// BlobHandler serves blobs from the storage backend. The wildcard part of
+// the route is appended to prefix to form the key.
+func BlobHandler(store storage.Storage, prefix string) http.HandlerFunc {
+	return blobHandler(store, prefix, nil)
+}
+
+// LocationStrippedBlobHandler is BlobHandler for originals that may carry
+// GPS data: every image is served with its location removed, the stored
+// file stays untouched. The stripped copy is made on the first request
+// and kept in storage (see services.StrippedKey), later requests stream
+// it. Files that cannot be stripped are not served.
+func LocationStrippedBlobHandler(store storage.Storage, prefix string) http.HandlerFunc {
+	return blobHandler(store, prefix, &singleflight.Group{})
+}
+
+// blobHandler serves the stripped copies of blobs if strips is not nil.
+func blobHandler(store storage.Storage, prefix string, strips *singleflight.Group) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := prefix + chi.URLParam(r, "*")
+
+		info, err := store.Stat(r.Context(), key)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("Stat %s: %v", key, err)
+			http.Error(w, "storage error", http.StatusInternalServerError)
+			return
+		}
+
+		if strips != nil {
+			// one copy per original, however many requests ask for it at once
+			v, err, _ := strips.Do(key, func() (any, error) {
+				return strippedCopy(context.WithoutCancel(r.Context()), store, key, info)
+			})
+			if errors.Is(err, services.ErrUnstrippable) {
+				log.Printf("Strip location %s: %v", key, err)
+				http.Error(w, "cannot serve this file without its location", http.StatusInternalServerError)
+				return
+			}
+			if err != nil {
+				log.Printf("Strip location %s: %v", key, err)
+				http.Error(w, "storage error", http.StatusInternalServerError)
+				return
+			}
+			contentType := info.ContentType
+			info = v.(storage.Info)
+			info.ContentType = contentType
+		}
+
+		obj, err := store.Get(r.Context(), info.Key)
+		if err != nil {
+			log.Printf("Get %s: %v", info.Key, err)
+			http.Error(w, "storage error", http.StatusInternalServerError)
+			return
+		}
+		defer obj.Close()
+
+		if info.ContentType != "" {
+			w.Header().Set("Content-Type", info.ContentType)
+		}
+		http.ServeContent(w, r, key, info.ModTime, obj)
+	}
+}
+
+// strippedCopy returns the stored stripped copy of the blob key, making it
+// first if there is none yet or it is older than the blob.
+func strippedCopy(ctx context.Context, store storage.Storage, key string, orig storage.Info) (storage.Info, error) {
+	strippedKey := services.StrippedKey(key)
+	info, err := store.Stat(ctx, strippedKey)
+	if err == nil && !info.ModTime.Before(orig.ModTime) {
+		info.Key = strippedKey
+		return info, nil
+	}
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return storage.Info{}, fmt.Errorf("stat stripped copy: %w", err)
+	}
+
+	obj, err := store.Get(ctx, key)
+	if err != nil {
+		return storage.Info{}, fmt.Errorf("get: %w", err)
+	}
+	data, err := io.ReadAll(io.LimitReader(obj, maxUploadSize+1))
+	obj.Close()
+	if err != nil {
+		return storage.Info{}, fmt.Errorf("read: %w", err)
+	}
+	stripped, err := services.StripLocation(data)
+	if err != nil {
+		return storage.Info{}, err
+	}
+	if err := store.Put(ctx, strippedKey, bytes.NewReader(stripped), int64(len(stripped)), orig.ContentType); err != nil {
+		return storage.Info{}, fmt.Errorf("store stripped copy: %w", err)
+	}
+
+	info, err = store.Stat(ctx, strippedKey)
+	if err != nil {
+		return storage.Info{}, fmt.Errorf("stat stripped copy: %w", err)
+	}
+	info.Key = strippedKey
+	return info, nil
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"imageapp/internal/services"
+	"imageapp/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// countingStore counts the reads of each key.
+type countingStore struct {
+	storage.Storage
+	gets map[string]*atomic.Int64
+}
+
+func (s countingStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	if n := s.gets[key]; n != nil {
+		n.Add(1)
+	}
+	return s.Storage.Get(ctx, key)
+}
+
+// pngWithText is a PNG carrying a location in a tEXt chunk.
+func pngWithText(t *testing.T, text string) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	iend := len(data) - 12
+
+	payload := []byte("Comment\x00" + text)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	chunk = append(chunk, "tEXt"...)
+	chunk = append(chunk, payload...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	out := append([]byte{}, data[:iend]...)
+	out = append(out, chunk...)
+	return append(out, data[iend:]...)
+}
+
+func TestLocationStrippedBlobHandler(t *testing.T) {
+	ctx := context.Background()
+	local, err := storage.NewLocal(t.TempDir(), "/uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "originals/gps.png"
+	data := pngWithText(t, "GPS 37.8N 122.4W")
+	if err := local.Put(ctx, key, bytes.NewReader(data), int64(len(data)), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	store := countingStore{local, map[string]*atomic.Int64{key: {}}}
+
+	r := chi.NewRouter()
+	r.Get("/uploads/*", LocationStrippedBlobHandler(store, ""))
+
+	for i := range 3 {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/uploads/"+key, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, rec.Code)
+		}
+		if bytes.Contains(rec.Body.Bytes(), []byte("GPS")) {
+			t.Fatalf("request %d: location served", i)
+		}
+		if _, err := png.Decode(rec.Body); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if n := store.gets[key].Load(); n != 1 {
+		t.Errorf("original read %d times, want once for the stripped copy", n)
+	}
+	if _, err := local.Stat(ctx, services.StrippedKey(key)); err != nil {
+		t.Errorf("stripped copy not stored: %v", err)
+	}
+
+	// unparsable files are not served
+	if err := local.Put(ctx, "originals/bad.png", bytes.NewReader([]byte("junk")), 4, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/uploads/originals/bad.png", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("unparsable file: status %d, want 500", rec.Code)
+	}
+}
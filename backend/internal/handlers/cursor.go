@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// feedCursor is the position after the last item of a page: the value the
+// list is sorted by plus the id as tiebreaker, so rows with equal keys are
+// neither skipped nor repeated. Kind names the ordering the cursor belongs
+// to, a cursor from one ordering is rejected by the others.
+type feedCursor struct {
+	Kind  string    `json:"k"`
+	Time  time.Time `json:"t,omitzero"` // created_at for "recent"
+	Score float64   `json:"s,omitempty"`
+	ID    int64     `json:"i"`
+}
+
+// encodeCursor returns the cursor as base64url(JSON) + "." + base64url(HMAC).
+// The signature keeps clients from crafting positions, they can only hand
+// back what the server gave them.
+func encodeCursor(key []byte, c feedCursor) string {
+	payload, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(signCursor(key, payload))
+}
+
+// decodeCursor verifies and parses a cursor of the given kind. An empty
+// string is the first page and returns nil.
+func decodeCursor(key []byte, s, kind string) (*feedCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	p, sig, found := bytes.Cut([]byte(s), []byte("."))
+	if !found {
+		return nil, errInvalidCursor
+	}
+	payload, err1 := base64.RawURLEncoding.DecodeString(string(p))
+	mac, err2 := base64.RawURLEncoding.DecodeString(string(sig))
+	if err1 != nil || err2 != nil || !hmac.Equal(mac, signCursor(key, payload)) {
+		return nil, errInvalidCursor
+	}
+
+	var c feedCursor
+	if err := json.Unmarshal(payload, &c); err != nil || c.Kind != kind {
+		return nil, errInvalidCursor
+	}
+	return &c, nil
+}
+
+func signCursor(key, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil)[:16]
+}
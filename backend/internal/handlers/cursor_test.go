@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	key := []byte("secret")
+	cursors := []feedCursor{
+		{Kind: "recent", Time: time.Date(2024, 5, 1, 12, 0, 0, 123456000, time.UTC), ID: 42},
+		{Kind: "semantic:tags", Score: 0.1234567890123, ID: 7},
+		{Kind: "similar:visual:3", Score: 0, ID: 1},
+	}
+	for _, c := range cursors {
+		got, err := decodeCursor(key, encodeCursor(key, c), c.Kind)
+		if err != nil {
+			t.Fatalf("%s: %v", c.Kind, err)
+		}
+		if !got.Time.Equal(c.Time) || got.Score != c.Score || got.ID != c.ID || got.Kind != c.Kind {
+			t.Errorf("%s: decoded %+v, want %+v", c.Kind, *got, c)
+		}
+	}
+
+	if got, err := decodeCursor(key, "", "recent"); got != nil || err != nil {
+		t.Errorf("empty cursor: got %v, %v, want the first page", got, err)
+	}
+}
+
+func TestCursorRejected(t *testing.T) {
+	key := []byte("secret")
+	valid := encodeCursor(key, feedCursor{Kind: "semantic:tags", Score: 0.5, ID: 10})
+	payload, sig, _ := strings.Cut(valid, ".")
+
+	// the same position moved forward, signed with the original signature
+	forged := b64(`{"k":"semantic:tags","s":0.5,"i":11}`)
+
+	mac, _ := base64.RawURLEncoding.DecodeString(sig)
+	mac[0] ^= 1
+	flipped := base64.RawURLEncoding.EncodeToString(mac)
+
+	tests := []struct {
+		name   string
+		cursor string
+		key    []byte
+		kind   string
+	}{
+		{"tampered payload", forged + "." + sig, key, "semantic:tags"},
+		{"tampered signature", payload + "." + flipped, key, "semantic:tags"},
+		{"no signature", payload, key, "semantic:tags"},
+		{"other key", valid, []byte("other"), "semantic:tags"},
+		{"wrong kind", valid, key, "lexical:tags"},
+		{"wrong kind for recent", valid, key, "recent"},
+		{"not base64", "!!!.???", key, "semantic:tags"},
+		{"signed but not json", b64("x") + "." + b64(string(signCursor(key, []byte("x")))), key, "semantic:tags"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := decodeCursor(tt.key, tt.cursor, tt.kind)
+			if !errors.Is(err, errInvalidCursor) {
+				t.Errorf("got %+v, %v, want errInvalidCursor", c, err)
+			}
+		})
+	}
+}
+
+func b64(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func TestCursorBoundToQuery(t *testing.T) {
+	key := []byte("secret")
+	parse := func(filter string) ParsedQuery {
+		q, err := parseQuery(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+	cat := searchKind("semantic", "tags", "minilm", parse("cat"), false)
+	cursor := encodeCursor(key, feedCursor{Kind: cat, Score: 0.2, ID: 5})
+
+	if _, err := decodeCursor(key, cursor, searchKind("semantic", "tags", "minilm", parse("  CAT "), false)); err != nil {
+		t.Errorf("same query in other case and spacing: %v", err)
+	}
+	others := map[string]string{
+		"other filter":   searchKind("semantic", "tags", "minilm", parse("dog"), false),
+		"other weight":   searchKind("semantic", "tags", "minilm", parse("cat^2"), false),
+		"negated term":   searchKind("semantic", "tags", "minilm", parse("cat -dog"), false),
+		"quoted":         searchKind("semantic", "tags", "minilm", parse(`"cat"`), false),
+		"other model":    searchKind("semantic", "tags", "bge", parse("cat"), false),
+		"with reranking": searchKind("semantic", "tags", "minilm", parse("cat"), true),
+	}
+	for name, kind := range others {
+		if _, err := decodeCursor(key, cursor, kind); !errors.Is(err, errInvalidCursor) {
+			t.Errorf("%s: got %v, want errInvalidCursor", name, err)
+		}
+	}
+
+	// through the handler; lexical search needs no embedding before the check
+	h := NewFeedHandler(nil, nil, nil, nil, nil, nil, FeedConfig{CursorKey: string(key)})
+	lexical := encodeCursor(key, feedCursor{Kind: searchKind("lexical", "tags", "", parse("cat"), false), Score: 0.2, ID: 5})
+	rec := httptest.NewRecorder()
+	h.Feed(rec, httptest.NewRequest(http.MethodGet, "/api/feed?mode=lexical&filter=dog&cursor="+lexical, nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("cursor of filter=cat for filter=dog: status %d, want 400", rec.Code)
+	}
+}
@@ -2,63 +2,204 @@ package handlers
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"imageapp/internal/services"
+	"imageapp/internal/storage"
 
 	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
 	pgvector "github.com/pgvector/pgvector-go"
 )
 
 type FeedItem struct {
-	ID           int64     `json:"id"`
-	Title        string    `json:"title"`
-	Tags         []string  `json:"tags"`
-	ImageURL     string    `json:"image_url"`
-	ThumbnailURL string    `json:"thumbnail_url"`
-	CreatedAt    time.Time `json:"created_at"`
-	Score        *float64  `json:"score,omitempty"`
+	ID           int64                   `json:"id"`
+	Title        string                  `json:"title"`
+	Tags         []string                `json:"tags"`
+	ImageURL     string                  `json:"image_url"`
+	ThumbnailURL string                  `json:"thumbnail_url"`
+	Renditions   map[string]RenditionURL `json:"renditions,omitempty"`
+	CreatedAt    time.Time               `json:"created_at"`
+	Score        *float64                `json:"score,omitempty"`
+
+	// sortKey is what the next page's cursor is positioned by if it differs
+	// from Score, the exact distance for nearest-neighbour searches.
+	sortKey *float64
+}
+
+// RenditionURL is one entry of a srcset.
+type RenditionURL struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
 }
 
 type FeedHandler struct {
-	db       *pgxpool.Pool
-	embedder *services.EmbeddingService
+	db        services.DB
+	store     storage.Storage
+	models    services.TextModels
+	clip      services.VisualEncoder
+	queries   *services.QueryCache
+	reranker  services.CrossEncoder
+	reranks   *rerankCache
+	config    FeedConfig
+	cursorKey []byte
 }
 
-func NewFeedHandler(db *pgxpool.Pool, embedder *services.EmbeddingService) *FeedHandler {
+// FeedConfig holds the search settings of the feed handler.
+type FeedConfig struct {
+	VisualMinScore float64
+	// NegativeMinScore and VisualNegativeMinScore are how similar an image
+	// must be to a negated term to be left out, for tag and visual search.
+	NegativeMinScore       float64
+	VisualNegativeMinScore float64
+	MaxPixels              int
+	// RerankCandidates is how many vector search hits the cross-encoder
+	// re-scores when a request asks for rerank=true.
+	RerankCandidates int
+	// CursorKey signs pagination cursors. If empty, a random key is used
+	// and cursors stop working when the server restarts.
+	CursorKey string
+}
+
+// NewFeedHandler creates the feed handler. clip may be nil, then only
+// tag-based search is available. reranker may be nil, then rerank=true is
+// rejected.
+func NewFeedHandler(db services.DB, store storage.Storage, models services.TextModels, clip services.VisualEncoder, queries *services.QueryCache, reranker services.CrossEncoder, config FeedConfig) *FeedHandler {
+	cursorKey := []byte(config.CursorKey)
+	if len(cursorKey) == 0 {
+		cursorKey = make([]byte, 32)
+		rand.Read(cursorKey)
+	}
 	return &FeedHandler{
-		db:       db,
-		embedder: embedder,
+		db:        db,
+		store:     store,
+		models:    models,
+		clip:      clip,
+		queries:   queries,
+		reranker:  reranker,
+		reranks:   newRerankCache(),
+		config:    config,
+		cursorKey: cursorKey,
+	}
+}
+
+// searchSpace is a vector column together with the query vector for it.
+// Rows at least negativeMinScore similar to one of the negatives are left
+// out.
+type searchSpace struct {
+	column           string
+	model            string // that embedded vector, part of cursors
+	vector           []float32
+	negatives        [][]float32
+	minScore         float64
+	negativeMinScore float64
+}
+
+// args starts the arguments of a search in this space, $1 is the query
+// vector.
+func (s searchSpace) args() sqlArgs {
+	return sqlArgs{pgvector.NewVector(s.vector)}
+}
+
+// where returns the threshold condition and the one for the negatives,
+// adding their arguments to args.
+func (s searchSpace) where(args *sqlArgs) string {
+	// s.column is one of our own column names, never user input
+	minScore := args.add(s.minScore)
+	var clause strings.Builder
+	fmt.Fprintf(&clause, "1 - (%s <=> $1) > %s", s.column, minScore)
+	if len(s.negatives) > 0 {
+		negativeMinScore := args.add(s.negativeMinScore)
+		for _, vec := range s.negatives {
+			fmt.Fprintf(&clause, " AND 1 - (%s <=> %s) < %s", s.column, args.add(pgvector.NewVector(vec)), negativeMinScore)
+		}
 	}
+	return clause.String()
 }
 
 func (h *FeedHandler) Feed(w http.ResponseWriter, r *http.Request) {
-	cursor := r.URL.Query().Get("cursor")
 	filter := r.URL.Query().Get("filter")
-	limitStr := r.URL.Query().Get("limit")
+	limit := parseLimit(r)
+	search, ok := h.parseSearch(w, r)
+	if !ok {
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "semantic"
+	}
+	if mode != "semantic" && mode != "lexical" && mode != "hybrid" {
+		http.Error(w, "mode must be semantic, lexical or hybrid", http.StatusBadRequest)
+		return
+	}
+	rerank := r.URL.Query().Get("rerank") == "true"
+	if rerank && h.reranker == nil {
+		http.Error(w, "re-ranking is not enabled", http.StatusBadRequest)
+		return
+	}
+	if rerank && mode != "semantic" {
+		http.Error(w, "rerank is only supported with mode=semantic", http.StatusBadRequest)
+		return
+	}
 
-	limit := 20
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 50 {
-			limit = l
+	var query ParsedQuery
+	if filter != "" {
+		q, err := parseQuery(filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		query = q
 	}
 
-	var items []FeedItem
-	var err error
+	// embedded first: the cursor is bound to the model that embedded the
+	// query, scores from another one are not comparable
+	var space searchSpace
+	if filter != "" && mode != "lexical" {
+		var err error
+		space, err = h.searchSpace(r.Context(), query, search)
+		if err != nil {
+			log.Printf("Feed error: %v", err)
+			http.Error(w, "query failed", http.StatusInternalServerError)
+			return
+		}
+	}
 
+	kind := "recent"
 	if filter != "" {
-		items, err = h.filteredFeed(r.Context(), filter, cursor, limit)
+		kind = searchKind(mode, search, space.model, query, rerank)
+	}
+	cursor, err := decodeCursor(h.cursorKey, r.URL.Query().Get("cursor"), kind)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var items []FeedItem
+
+	if filter != "" && mode == "lexical" {
+		items, err = h.lexicalFeed(r.Context(), query.Lexical(), cursor, limit)
+	} else if filter != "" && mode == "hybrid" {
+		items, err = h.hybridFeed(r.Context(), query.Lexical(), space, cursor, limit)
+	} else if filter != "" && rerank {
+		items, err = h.rerankedFeed(r.Context(), query.Text(), kind, space, cursor, limit)
+	} else if filter != "" {
+		items, err = h.filteredFeed(r.Context(), space, cursor, limit)
 	} else {
 		items, err = h.normalFeed(r.Context(), cursor, limit)
 	}
 
+	if err == nil {
+		err = h.attachRenditions(r.Context(), items)
+	}
+
 	if err != nil {
 		log.Printf("Feed error: %v", err) // add logging!
 		http.Error(w, "query failed", http.StatusInternalServerError)
@@ -67,42 +208,66 @@ func (h *FeedHandler) Feed(w http.ResponseWriter, r *http.Request) {
 
 	var nextCursor string
 	if len(items) == limit {
-		nextCursor = items[len(items)-1].CreatedAt.Format(time.RFC3339Nano)
+		last := items[len(items)-1]
+		next := feedCursor{Kind: kind, ID: last.ID}
+		if last.sortKey != nil {
+			next.Score = *last.sortKey
+		} else if last.Score != nil {
+			next.Score = *last.Score
+		} else {
+			next.Time = last.CreatedAt
+		}
+		nextCursor = encodeCursor(h.cursorKey, next)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{
+	response := map[string]any{
 		"items":       items,
 		"next_cursor": nextCursor,
 		"filter":      filter,
-	})
+		"search":      search,
+		"mode":        mode,
+		"rerank":      rerank,
+	}
+	if filter != "" {
+		response["query"] = query
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
-func (h *FeedHandler) normalFeed(ctx context.Context, cursor string, limit int) ([]FeedItem, error) {
+// searchKind is the cursor kind of a filtered feed. A cursor only
+// continues the same ordering of the same query, embedded with the same
+// model; model is empty for lexical search.
+func searchKind(mode, search, model string, query ParsedQuery, rerank bool) string {
+	kind := fmt.Sprintf("%s:%s:%s:%s", mode, search, model, query.key())
+	if rerank {
+		kind += ":rerank"
+	}
+	return kind
+}
+
+func (h *FeedHandler) normalFeed(ctx context.Context, cursor *feedCursor, limit int) ([]FeedItem, error) {
 	var rows pgx.Rows
 	var err error
 
-	if cursor == "" {
+	if cursor == nil {
 		rows, err = h.db.Query(ctx, `
 			SELECT id, title, tags, image_url, thumbnail_path, created_at
 			FROM images
 			WHERE thumbnail_status = 'ready'
-			ORDER BY created_at DESC
+			ORDER BY created_at DESC, id DESC
 			LIMIT $1
 		`, limit)
 	} else {
-		cursorTime, parseErr := time.Parse(time.RFC3339Nano, cursor)
-		if parseErr != nil {
-			return nil, fmt.Errorf("invalid cursor: %w", parseErr)
-		}
 		rows, err = h.db.Query(ctx, `
 			SELECT id, title, tags, image_url, thumbnail_path, created_at
 			FROM images
 			WHERE thumbnail_status = 'ready'
-			  AND created_at < $1
-			ORDER BY created_at DESC
-			LIMIT $2
-		`, cursorTime, limit)
+			  AND (created_at, id) < ($1, $2)
+			ORDER BY created_at DESC, id DESC
+			LIMIT $3
+		`, cursor.Time, cursor.ID, limit)
 	}
 
 	if err != nil {
@@ -110,53 +275,139 @@ func (h *FeedHandler) normalFeed(ctx context.Context, cursor string, limit int)
 	}
 	defer rows.Close()
 
-	return scanFeedItems(rows)
+	return h.scanFeedItems(rows)
 }
 
-func (h *FeedHandler) filteredFeed(ctx context.Context, filter, cursor string, limit int) ([]FeedItem, error) {
-	filterVec, err := h.embedder.EmbedTags(filter)
+// searchSpace embeds the query terms for the requested search: "tags"
+// compares them to the tag embeddings, "visual" runs them through the CLIP
+// text encoder and compares them to the image content embeddings. The
+// positive terms are averaged by weight into one vector.
+func (h *FeedHandler) searchSpace(ctx context.Context, query ParsedQuery, search string) (searchSpace, error) {
+	model, err := h.models.Active(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("embed filter: %w", err)
+		return searchSpace{}, err
+	}
+	space := searchSpace{
+		column:           "embedding",
+		model:            model.Name,
+		minScore:         0.3,
+		negativeMinScore: h.config.NegativeMinScore,
+	}
+	embed := func(text string) ([]float32, error) {
+		return h.queries.Embed(model.Name, text, func(text string) ([]float32, error) {
+			return model.Embedder.EmbedTags(text)
+		})
+	}
+	if search == "visual" {
+		space = searchSpace{
+			column:           "image_embedding",
+			model:            "clip",
+			minScore:         h.config.VisualMinScore,
+			negativeMinScore: h.config.VisualNegativeMinScore,
+		}
+		embed = func(text string) ([]float32, error) {
+			return h.queries.Embed("clip", text, h.clip.EmbedText)
+		}
 	}
 
-	var rows pgx.Rows
+	for _, term := range query.Terms {
+		vec, err := embed(term.Text)
+		if err != nil {
+			return searchSpace{}, fmt.Errorf("embed %q: %w", term.Text, err)
+		}
+		if term.Negative {
+			space.negatives = append(space.negatives, vec)
+			continue
+		}
+		if space.vector == nil {
+			space.vector = make([]float32, len(vec))
+		}
+		for i := range vec {
+			space.vector[i] += float32(term.Weight) * vec[i]
+		}
+	}
+	services.Normalize(space.vector)
+	return space, nil
+}
 
-	if cursor == "" {
-		rows, err = h.db.Query(ctx, `
-			SELECT id, title, tags, image_url, thumbnail_path, created_at,
-			       1 - (embedding <=> $1) AS similarity
-			FROM images
-			WHERE thumbnail_status = 'ready'
-			  AND 1 - (embedding <=> $1) > 0.3
-			ORDER BY similarity DESC
-			LIMIT $2
-		`, pgvector.NewVector(filterVec), limit)
-	} else {
-		cursorTime, parseErr := time.Parse(time.RFC3339Nano, cursor)
-		if parseErr != nil {
-			return nil, fmt.Errorf("invalid cursor: %w", parseErr)
+// filteredFeed returns the images nearest to the query vector that pass
+// the space's threshold and negatives.
+func (h *FeedHandler) filteredFeed(ctx context.Context, space searchSpace, cursor *feedCursor, limit int) ([]FeedItem, error) {
+	args := space.args()
+	filter := space.where(&args)
+	return h.nearest(ctx, space.column, args, filter, cursor, limit)
+}
+
+func parseLimit(r *http.Request) int {
+	limit := 20
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 50 {
+			limit = l
 		}
-		rows, err = h.db.Query(ctx, `
-			SELECT id, title, tags, image_url, thumbnail_path, created_at,
-			       1 - (embedding <=> $1) AS similarity
-			FROM images
-			WHERE thumbnail_status = 'ready'
-			  AND 1 - (embedding <=> $1) > 0.3
-			  AND created_at < $2
-			ORDER BY similarity DESC
-			LIMIT $3
-		`, pgvector.NewVector(filterVec), cursorTime, limit)
 	}
+	return limit
+}
 
+// parseSearch reads the search parameter, "tags" (default) or "visual",
+// and answers 400 if it is invalid or not available.
+func (h *FeedHandler) parseSearch(w http.ResponseWriter, r *http.Request) (string, bool) {
+	search := r.URL.Query().Get("search")
+	if search == "" {
+		search = "tags"
+	}
+	if search != "tags" && search != "visual" {
+		http.Error(w, "search must be tags or visual", http.StatusBadRequest)
+		return "", false
+	}
+	if search == "visual" && h.clip == nil {
+		http.Error(w, "visual search is not enabled", http.StatusBadRequest)
+		return "", false
+	}
+	return search, true
+}
+
+// attachRenditions loads the renditions of all items with one query.
+func (h *FeedHandler) attachRenditions(ctx context.Context, items []FeedItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(items))
+	byID := make(map[int64]*FeedItem, len(items))
+	for i := range items {
+		ids[i] = items[i].ID
+		byID[items[i].ID] = &items[i]
+	}
+
+	rows, err := h.db.Query(ctx, `
+		SELECT image_id, name, storage_key, width, height
+		FROM image_renditions
+		WHERE image_id = ANY($1)
+	`, ids)
 	if err != nil {
-		return nil, fmt.Errorf("query: %w", err)
+		return fmt.Errorf("renditions: %w", err)
 	}
 	defer rows.Close()
 
-	return scanFeedItemsWithScore(rows)
+	for rows.Next() {
+		var id int64
+		var name, key string
+		var rendition RenditionURL
+		if err := rows.Scan(&id, &name, &key, &rendition.Width, &rendition.Height); err != nil {
+			return fmt.Errorf("scan rendition: %w", err)
+		}
+		rendition.URL = h.store.URL(key)
+
+		item := byID[id]
+		if item.Renditions == nil {
+			item.Renditions = make(map[string]RenditionURL)
+		}
+		item.Renditions[name] = rendition
+	}
+	return rows.Err()
 }
 
-func scanFeedItems(rows pgx.Rows) ([]FeedItem, error) {
+func (h *FeedHandler) scanFeedItems(rows pgx.Rows) ([]FeedItem, error) {
 	var items []FeedItem
 	for rows.Next() {
 		var item FeedItem
@@ -166,14 +417,14 @@ func scanFeedItems(rows pgx.Rows) ([]FeedItem, error) {
 			return nil, fmt.Errorf("scan: %w", err)
 		}
 		if thumbPath != nil {
-			item.ThumbnailURL = fmt.Sprintf("/thumbnails/thumb_%d.jpg", item.ID)
+			item.ThumbnailURL = h.store.URL(*thumbPath)
 		}
 		items = append(items, item)
 	}
-	return items, nil
+	return items, rows.Err()
 }
 
-func scanFeedItemsWithScore(rows pgx.Rows) ([]FeedItem, error) {
+func (h *FeedHandler) scanFeedItemsWithScore(rows pgx.Rows) ([]FeedItem, error) {
 	var items []FeedItem
 	for rows.Next() {
 		var item FeedItem
@@ -185,9 +436,9 @@ func scanFeedItemsWithScore(rows pgx.Rows) ([]FeedItem, error) {
 		}
 		item.Score = &score
 		if thumbPath != nil {
-			item.ThumbnailURL = fmt.Sprintf("/thumbnails/thumb_%d.jpg", item.ID)
+			item.ThumbnailURL = h.store.URL(*thumbPath)
 		}
 		items = append(items, item)
 	}
-	return items, nil
+	return items, rows.Err()
 }
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"imageapp/internal/services"
+	"imageapp/internal/storage"
+	"imageapp/internal/testdb"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// fakeReranker scores every document 0.
+type fakeReranker struct{}
+
+func (fakeReranker) Score(_ string, docs []string) ([]float64, error) {
+	return make([]float64, len(docs)), nil
+}
+
+func TestFeedRejectsBadRequests(t *testing.T) {
+	key := "test"
+	recent := encodeCursor([]byte(key), feedCursor{Kind: "recent", ID: 1})
+
+	tests := []struct {
+		name     string
+		reranker bool
+		query    url.Values
+	}{
+		{"unknown mode", false, url.Values{"mode": {"fuzzy"}, "filter": {"cat"}}},
+		{"unknown search", false, url.Values{"search": {"smell"}, "filter": {"cat"}}},
+		{"visual search without clip", false, url.Values{"search": {"visual"}, "filter": {"cat"}}},
+		{"rerank without reranker", false, url.Values{"rerank": {"true"}, "filter": {"cat"}}},
+		{"rerank with lexical mode", true, url.Values{"rerank": {"true"}, "mode": {"lexical"}, "filter": {"cat"}}},
+		{"only negated terms", false, url.Values{"filter": {"-cat"}}},
+		{"weight out of range", false, url.Values{"filter": {"cat^0"}}},
+		{"garbage cursor", false, url.Values{"cursor": {"garbage"}}},
+		{"cursor of another ordering", false, url.Values{"filter": {"cat"}, "mode": {"lexical"}, "cursor": {recent}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewFeedHandler(nil, nil, nil, nil, nil, nil, FeedConfig{CursorKey: key})
+			if tt.reranker {
+				h = NewFeedHandler(nil, nil, nil, nil, nil, fakeReranker{}, FeedConfig{CursorKey: key})
+			}
+			rec := httptest.NewRecorder()
+			h.Feed(rec, httptest.NewRequest(http.MethodGet, "/api/feed?"+tt.query.Encode(), nil))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("status %d, want 400 (%s)", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+// fakeVisual embeds text like insertImage embeds images by default: the
+// fake text embedding, zero-padded to the CLIP size.
+type fakeVisual struct{}
+
+func (fakeVisual) EmbedImage(image.Image) ([]float32, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (fakeVisual) EmbedText(text string) ([]float32, error) {
+	vec, _ := fakeEmbedder.EmbedTags(text)
+	padded := make([]float32, services.ClipDim)
+	copy(padded, vec)
+	return padded, nil
+}
+
+type pageItem struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Score     *float64  `json:"score"`
+}
+
+// pageThrough follows next_cursor from the first page to the last and
+// returns all items in the order they were served.
+func pageThrough(t *testing.T, h http.Handler, path string, query url.Values, limit int) []pageItem {
+	t.Helper()
+	var all []pageItem
+	cursor := ""
+	for page := 0; ; page++ {
+		if page > 100 {
+			t.Fatal("pagination does not end")
+		}
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set("limit", strconv.Itoa(limit))
+		if cursor != "" {
+			q.Set("cursor", cursor)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"?"+q.Encode(), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		var resp struct {
+			Items      []pageItem `json:"items"`
+			NextCursor string     `json:"next_cursor"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, resp.Items...)
+		if resp.NextCursor == "" {
+			return all
+		}
+		cursor = resp.NextCursor
+	}
+}
+
+func TestFeedPagination(t *testing.T) {
+	db := testdb.New(t)
+	store, err := storage.NewLocal(t.TempDir(), "/storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewFeedHandler(db, store, testdb.Models(t, db, fakeEmbedder), fakeVisual{},
+		services.NewQueryCache(16), fakeReranker{}, FeedConfig{
+			VisualMinScore:   0.2,
+			RerankCandidates: 50,
+			CursorKey:        "test",
+		})
+	r := chi.NewRouter()
+	r.Get("/api/feed", h.Feed)
+	r.Get("/api/images/{id}/similar", h.Similar)
+
+	// groups of rows with the same created_at and the same tags, so both
+	// the timestamps and the scores tie
+	t0 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Hour)
+	var ids []int64
+	for i := range 13 {
+		img := testImage{title: "photo", tags: []string{"beach"}, createdAt: t0}
+		switch {
+		case i >= 10:
+			img.tags = []string{"mountain"}
+		case i >= 6:
+			img.tags = []string{"beach", "sunset"}
+			img.createdAt = t1
+		}
+		ids = append(ids, insertImage(t, db, img))
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		query url.Values
+	}{
+		{"recent", "/api/feed", url.Values{}},
+		{"semantic", "/api/feed", url.Values{"filter": {"beach"}}},
+		{"visual", "/api/feed", url.Values{"filter": {"beach"}, "search": {"visual"}}},
+		{"lexical", "/api/feed", url.Values{"filter": {"beach"}, "mode": {"lexical"}}},
+		{"hybrid", "/api/feed", url.Values{"filter": {"beach"}, "mode": {"hybrid"}}},
+		{"rerank", "/api/feed", url.Values{"filter": {"beach"}, "rerank": {"true"}}},
+		{"similar", "/api/images/" + itoa(ids[0]) + "/similar", url.Values{}},
+		{"similar visual", "/api/images/" + itoa(ids[0]) + "/similar", url.Values{"search": {"visual"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			full := pageThrough(t, r, tt.path, tt.query, 50)
+			if len(full) < 6 {
+				t.Fatalf("only %d results, the test needs ties", len(full))
+			}
+			for i := 1; i < len(full); i++ {
+				if !servedInOrder(tt.name, full[i-1], full[i]) {
+					t.Fatalf("results out of order at %d: %+v before %+v", i, full[i-1], full[i])
+				}
+			}
+
+			for _, limit := range []int{1, 2, 5} {
+				paged := pageThrough(t, r, tt.path, tt.query, limit)
+				seen := make(map[int64]bool)
+				for _, item := range paged {
+					if seen[item.ID] {
+						t.Errorf("limit %d: image %d served twice", limit, item.ID)
+					}
+					seen[item.ID] = true
+				}
+				if !slices.EqualFunc(paged, full, func(a, b pageItem) bool { return a.ID == b.ID }) {
+					t.Errorf("limit %d: pages give %v, want %v", limit, pageIDs(paged), pageIDs(full))
+				}
+			}
+		})
+	}
+}
+
+// servedInOrder reports whether a may come before b: newest first for
+// the recent feed, highest score first otherwise, ties by id.
+func servedInOrder(mode string, a, b pageItem) bool {
+	if mode == "recent" {
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.After(b.CreatedAt)
+		}
+		return a.ID > b.ID
+	}
+	if *a.Score != *b.Score {
+		return *a.Score > *b.Score
+	}
+	return a.ID < b.ID
+}
+
+func pageIDs(items []pageItem) []int64 {
+	ids := make([]int64, len(items))
+	for i, item := range items {
+		ids[i] = item.ID
+	}
+	return ids
+}
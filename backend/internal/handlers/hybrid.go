@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// hybridCandidates is how many hits each retriever contributes to the
+	// fusion; hybrid results are paged within this window.
+	hybridCandidates = 200
+	// rrfK damps the influence of the top ranks, 60 is the value from the
+	// original reciprocal rank fusion paper.
+	rrfK = 60
+)
+
+// rankedID is an image id with its fused score.
+type rankedID struct {
+	score float64
+	id    int64
+}
+
+// lexicalFeed runs a full-text search over title and tags. ts_rank_cd with
+// normalization 1 divides by the log of the document length, which gets
+// close to BM25 for short documents like ours.
+func (h *FeedHandler) lexicalFeed(ctx context.Context, filter string, cursor *feedCursor, limit int) ([]FeedItem, error) {
+	var afterScore *float64
+	var afterID int64
+	if cursor != nil {
+		afterScore, afterID = &cursor.Score, cursor.ID
+	}
+
+	rows, err := h.db.Query(ctx, `
+		SELECT id, title, tags, image_url, thumbnail_path, created_at, rank
+		FROM (
+			SELECT id, title, tags, image_url, thumbnail_path, created_at,
+			       ts_rank_cd(search_vector, query, 1)::float8 AS rank
+			FROM images, websearch_to_tsquery('english', $1) query
+			WHERE thumbnail_status = 'ready'
+			  AND search_vector @@ query
+		) hits
+		WHERE $2::float8 IS NULL OR rank < $2 OR (rank = $2 AND id > $3)
+		ORDER BY rank DESC, id
+		LIMIT $4
+	`, filter, afterScore, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	return h.scanFeedItemsWithScore(rows)
+}
+
+// hybridFeed runs the vector and the full-text retrieval in parallel and
+// merges them with reciprocal rank fusion: every image scores the sum of
+// 1/(rrfK + rank) over the lists it appears in, so an exact title or tag
+// match survives even when its embedding is below the similarity threshold.
+// Only the best hybridCandidates of each list are fused, so paging ends
+// after at most twice that many results.
+func (h *FeedHandler) hybridFeed(ctx context.Context, filter string, space searchSpace, cursor *feedCursor, limit int) ([]FeedItem, error) {
+	var semanticIDs, lexicalIDs []int64
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		args := space.args()
+		filter := space.where(&args)
+		items, err := h.nearest(gctx, space.column, args, filter, nil, hybridCandidates)
+		if err != nil {
+			return fmt.Errorf("semantic query: %w", err)
+		}
+		for _, item := range items {
+			semanticIDs = append(semanticIDs, item.ID)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		rows, err := h.db.Query(gctx, `
+			SELECT id
+			FROM images, websearch_to_tsquery('english', $1) query
+			WHERE thumbnail_status = 'ready'
+			  AND search_vector @@ query
+			ORDER BY ts_rank_cd(search_vector, query, 1) DESC, id
+			LIMIT $2
+		`, filter, hybridCandidates)
+		if err != nil {
+			return fmt.Errorf("lexical query: %w", err)
+		}
+		lexicalIDs, err = pgx.CollectRows(rows, pgx.RowTo[int64])
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	fused := fuseRanks(semanticIDs, lexicalIDs)
+	if cursor != nil {
+		i := sort.Search(len(fused), func(i int) bool {
+			return fused[i].score < cursor.Score || (fused[i].score == cursor.Score && fused[i].id > cursor.ID)
+		})
+		fused = fused[i:]
+	}
+	if len(fused) > limit {
+		fused = fused[:limit]
+	}
+	if len(fused) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]int64, len(fused))
+	for i, f := range fused {
+		ids[i] = f.id
+	}
+	rows, err := h.db.Query(ctx, `
+		SELECT id, title, tags, image_url, thumbnail_path, created_at
+		FROM images
+		WHERE id = ANY($1)
+	`, ids)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	found, err := h.scanFeedItems(rows)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]FeedItem, len(found))
+	for _, item := range found {
+		byID[item.ID] = item
+	}
+
+	items := make([]FeedItem, 0, len(fused))
+	for _, f := range fused {
+		item, ok := byID[f.id]
+		if !ok {
+			continue // deleted in the meantime
+		}
+		score := f.score
+		item.Score = &score
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// fuseRanks combines ranked id lists with reciprocal rank fusion. The
+// result is ordered by fused score, ties broken by id.
+func fuseRanks(lists ...[]int64) []rankedID {
+	scores := make(map[int64]float64)
+	for _, ids := range lists {
+		for rank, id := range ids {
+			scores[id] += 1.0 / float64(rrfK+rank+1)
+		}
+	}
+
+	fused := make([]rankedID, 0, len(scores))
+	for id, score := range scores {
+		fused = append(fused, rankedID{score: score, id: id})
+	}
+	sort.Slice(fused, func(i, j int) bool {
+		if fused[i].score != fused[j].score {
+			return fused[i].score > fused[j].score
+		}
+		return fused[i].id < fused[j].id
+	})
+	return fused
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFuseRanks(t *testing.T) {
+	rrf := func(ranks ...int) float64 {
+		var s float64
+		for _, r := range ranks {
+			s += 1.0 / float64(rrfK+r)
+		}
+		return s
+	}
+	tests := []struct {
+		name     string
+		semantic []int64
+		lexical  []int64
+		want     []rankedID
+	}{
+		{"empty", nil, nil, []rankedID{}},
+		{"one retriever", []int64{7, 3}, nil, []rankedID{{rrf(1), 7}, {rrf(2), 3}}},
+		{
+			"found by both beats found by one",
+			[]int64{1, 2}, []int64{2, 3},
+			[]rankedID{{rrf(2, 1), 2}, {rrf(1), 1}, {rrf(2), 3}},
+		},
+		{
+			"lexical only still ranks",
+			[]int64{1, 2, 3}, []int64{9},
+			[]rankedID{{rrf(1), 1}, {rrf(1), 9}, {rrf(2), 2}, {rrf(3), 3}},
+		},
+		{"ties by id", []int64{5}, []int64{4}, []rankedID{{rrf(1), 4}, {rrf(1), 5}}},
+		{
+			"same rank sums tie",
+			[]int64{8, 6}, []int64{6, 8},
+			[]rankedID{{rrf(1, 2), 6}, {rrf(1, 2), 8}},
+		},
+	}
+	for _, tt := range tests {
+		got := fuseRanks(tt.semantic, tt.lexical)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].id != tt.want[i].id || math.Abs(got[i].score-tt.want[i].score) > 1e-12 {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestFuseRanksWindow(t *testing.T) {
+	// full candidate windows without overlap: the last rank of each list
+	// ties, and nothing past the window is scored
+	semantic := make([]int64, hybridCandidates)
+	lexical := make([]int64, hybridCandidates)
+	for i := range hybridCandidates {
+		semantic[i] = int64(2*i + 2)
+		lexical[i] = int64(2*i + 1)
+	}
+	got := fuseRanks(semantic, lexical)
+	if len(got) != 2*hybridCandidates {
+		t.Fatalf("%d fused, want %d", len(got), 2*hybridCandidates)
+	}
+	for i, r := range got {
+		if r.id != int64(i+1) {
+			t.Fatalf("position %d holds %d, want %d", i, r.id, i+1)
+		}
+	}
+	last := got[len(got)-1]
+	if want := 1.0 / float64(rrfK+hybridCandidates); last.score != want {
+		t.Errorf("last score %v, want %v", last.score, want)
+	}
+}
@@ -0,0 +1,434 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"imageapp/internal/models"
+	"imageapp/internal/services"
+	"imageapp/internal/storage"
+	"imageapp/internal/ws"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// RenderCache holds files derived from an image outside the storage.
+type RenderCache interface {
+	PurgeImage(id int64) error
+}
+
+type ImageHandler struct {
+	db           services.DB
+	store        storage.Storage
+	models       services.TextModels
+	hub          *ws.Hub
+	renders      RenderCache
+	hideLocation bool
+}
+
+// NewImageHandler creates the handler. With hideLocation the GPS part of
+// the stored metadata is left out of responses. Deleting an image also
+// purges it from renders.
+func NewImageHandler(db services.DB, store storage.Storage, models services.TextModels, hub *ws.Hub, renders RenderCache, hideLocation bool) *ImageHandler {
+	return &ImageHandler{
+		db:           db,
+		store:        store,
+		models:       models,
+		hub:          hub,
+		renders:      renders,
+		hideLocation: hideLocation,
+	}
+}
+
+type updateImageRequest struct {
+	Title *string   `json:"title"`
+	Tags  *[]string `json:"tags"`
+}
+
+type reviewSuggestionsRequest struct {
+	Accept []string `json:"accept"`
+	Reject []string `json:"reject"`
+}
+
+func (h *ImageHandler) Get(w http.ResponseWriter, r *http.Request) {
+	id, ok := imageID(w, r)
+	if !ok {
+		return
+	}
+
+	img, err := h.getImage(r.Context(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "image not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Get image error: %v", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(img)
+}
+
+// Update edits title and/or tags. Changed tags are re-embedded right away,
+// so the image shows up under its new tags in the filtered feed.
+func (h *ImageHandler) Update(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, ok := imageID(w, r)
+	if !ok {
+		return
+	}
+
+	var req updateImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Title != nil && strings.TrimSpace(*req.Title) == "" {
+		http.Error(w, "title must not be empty", http.StatusBadRequest)
+		return
+	}
+	if req.Tags != nil && len(*req.Tags) == 0 {
+		http.Error(w, "at least one tag is required", http.StatusBadRequest)
+		return
+	}
+
+	// the row stays locked until the new text is written, so concurrent
+	// edits apply one after the other instead of overwriting each other
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		log.Printf("Update image error: %v", err)
+		http.Error(w, "update failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	img, err := h.lockImage(ctx, tx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "image not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, services.ErrModelSwitched) {
+		http.Error(w, "embedding model changed, please retry", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("Update image error: %v", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	tagsChanged := req.Tags != nil && !slices.Equal(*req.Tags, img.Tags)
+	titleChanged := req.Title != nil && *req.Title != img.Title
+	if req.Title != nil {
+		img.Title = *req.Title
+	}
+	if req.Tags != nil {
+		img.Tags = *req.Tags
+		img.SuggestedTags = withoutSuggestions(img.SuggestedTags, img.Tags)
+	}
+
+	var vectors map[string][]float32
+	if tagsChanged || (titleChanged && h.models.Composer().UsesTitle()) {
+		vectors, err = h.models.EmbedImageText(ctx, img.Title, img.Tags)
+		if err != nil {
+			log.Printf("Update image error: %v", fmt.Errorf("embedding: %w", err))
+			http.Error(w, "embedding failed", http.StatusInternalServerError)
+			return
+		}
+	}
+	err = saveText(ctx, tx, img, vectors)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		log.Printf("Update image error: %v", err)
+		http.Error(w, "update failed", http.StatusInternalServerError)
+		return
+	}
+
+	h.hub.Broadcast(ws.Message{
+		Type:  "image_updated",
+		ID:    img.ID,
+		Title: img.Title,
+		Tags:  img.Tags,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(img)
+}
+
+// ReviewSuggestions moves accepted suggested tags into the tags, which are
+// then re-embedded, and drops rejected ones.
+func (h *ImageHandler) ReviewSuggestions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, ok := imageID(w, r)
+	if !ok {
+		return
+	}
+
+	var req reviewSuggestionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		log.Printf("Review suggestions error: %v", err)
+		http.Error(w, "update failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	img, err := h.lockImage(ctx, tx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "image not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, services.ErrModelSwitched) {
+		http.Error(w, "embedding model changed, please retry", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("Review suggestions error: %v", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	// accepted and rejected tags are stored as the suggestion spells them
+	suggested := func(tag string) (string, bool) {
+		i := slices.IndexFunc(img.SuggestedTags, func(s models.SuggestedTag) bool { return services.SameTag(s.Tag, tag) })
+		if i < 0 {
+			return "", false
+		}
+		return img.SuggestedTags[i].Tag, true
+	}
+	for _, tag := range slices.Concat(req.Accept, req.Reject) {
+		if _, ok := suggested(tag); !ok {
+			http.Error(w, fmt.Sprintf("%q is not a suggested tag", tag), http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, tag := range req.Reject {
+		label, _ := suggested(tag)
+		if !services.ContainsTag(img.RejectedTags, label) {
+			img.RejectedTags = append(img.RejectedTags, label)
+		}
+	}
+	for _, tag := range req.Accept {
+		label, _ := suggested(tag)
+		if !services.ContainsTag(img.Tags, label) {
+			img.Tags = append(img.Tags, label)
+		}
+	}
+	img.SuggestedTags = withoutSuggestions(img.SuggestedTags, slices.Concat(img.Tags, img.RejectedTags))
+
+	var vectors map[string][]float32
+	if len(req.Accept) > 0 {
+		vectors, err = h.models.EmbedImageText(ctx, img.Title, img.Tags)
+		if err != nil {
+			log.Printf("Review suggestions error: %v", fmt.Errorf("embedding: %w", err))
+			http.Error(w, "embedding failed", http.StatusInternalServerError)
+			return
+		}
+	}
+	err = saveText(ctx, tx, img, vectors)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		log.Printf("Review suggestions error: %v", err)
+		http.Error(w, "update failed", http.StatusInternalServerError)
+		return
+	}
+
+	h.hub.Broadcast(ws.Message{
+		Type:  "image_updated",
+		ID:    img.ID,
+		Title: img.Title,
+		Tags:  img.Tags,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(img)
+}
+
+// withoutSuggestions drops the suggestions whose tag is in tags.
+func withoutSuggestions(suggestions []models.SuggestedTag, tags []string) []models.SuggestedTag {
+	return slices.DeleteFunc(suggestions, func(s models.SuggestedTag) bool {
+		return services.ContainsTag(tags, s.Tag)
+	})
+}
+
+// Delete removes the row together with the original, its renditions and
+// cached renders.
+func (h *ImageHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	id, ok := imageID(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		log.Printf("Delete image error: %v", err)
+		http.Error(w, "delete failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// the row lock keeps the processor from recording more renditions
+	// until the row is gone, then its insert fails and it cleans up itself
+	var storageKey string
+	var thumbKey *string
+	err = tx.QueryRow(ctx, `
+		SELECT storage_path, thumbnail_path FROM images WHERE id = $1 FOR UPDATE
+	`, id).Scan(&storageKey, &thumbKey)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "image not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Delete image error: %v", err)
+		http.Error(w, "delete failed", http.StatusInternalServerError)
+		return
+	}
+	renditionKeys, err := deleteRenditions(ctx, tx, id)
+	if err == nil {
+		_, err = tx.Exec(ctx, "DELETE FROM images WHERE id = $1", id)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		log.Printf("Delete image error: %v", err)
+		http.Error(w, "delete failed", http.StatusInternalServerError)
+		return
+	}
+
+	// the files must go even if the client hangs up now
+	ctx = context.WithoutCancel(ctx)
+
+	// the row is gone, so leftover files are only logged
+	if err := h.store.Delete(ctx, storageKey); err != nil {
+		log.Printf("Failed to remove original of image %d: %v", id, err)
+	}
+	if err := h.store.Delete(ctx, services.StrippedKey(storageKey)); err != nil {
+		log.Printf("Failed to remove location-stripped original of image %d: %v", id, err)
+	}
+	// the thumbnail is one of the renditions, except in rows written
+	// before it was
+	if thumbKey != nil && !slices.Contains(renditionKeys, *thumbKey) {
+		if err := h.store.Delete(ctx, *thumbKey); err != nil {
+			log.Printf("Failed to remove thumbnail of image %d: %v", id, err)
+		}
+	}
+	for _, key := range renditionKeys {
+		if err := h.store.Delete(ctx, key); err != nil {
+			log.Printf("Failed to remove rendition of image %d: %v", id, err)
+		}
+	}
+	if err := h.renders.PurgeImage(id); err != nil {
+		log.Printf("Failed to remove cached renders of image %d: %v", id, err)
+	}
+
+	h.hub.Broadcast(ws.Message{
+		Type: "image_deleted",
+		ID:   id,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// saveText writes title, tags and suggestions inside tx, and the text
+// embeddings too unless vectors is nil.
+func saveText(ctx context.Context, tx pgx.Tx, img models.Image, vectors map[string][]float32) error {
+	if vectors != nil {
+		if err := services.WriteTextEmbeddings(ctx, tx, img.ID, img.Title, img.Tags, vectors); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(ctx, `
+		UPDATE images
+		SET title = $1, tags = $2, suggested_tags = $3, rejected_tags = $4
+		WHERE id = $5
+	`, img.Title, img.Tags, img.SuggestedTags, img.RejectedTags, img.ID)
+	return err
+}
+
+const imageColumns = `
+	id, title, tags, filename, size, mime, checksum, storage_path,
+	image_url, thumbnail_path, thumbnail_status, metadata,
+	suggested_tags, rejected_tags, created_at`
+
+func (h *ImageHandler) getImage(ctx context.Context, id int64) (models.Image, error) {
+	return h.scanImage(h.db.QueryRow(ctx, `
+		SELECT `+imageColumns+`
+		FROM images
+		WHERE id = $1
+	`, id))
+}
+
+// lockImage reads the image inside tx and locks its row until tx ends.
+// The active model is locked before, in the order every embedding writer
+// uses (see services.LockActiveModel).
+func (h *ImageHandler) lockImage(ctx context.Context, tx pgx.Tx, id int64) (models.Image, error) {
+	if _, err := services.LockActiveModel(ctx, tx); err != nil {
+		return models.Image{}, err
+	}
+	return h.scanImage(tx.QueryRow(ctx, `
+		SELECT `+imageColumns+`
+		FROM images
+		WHERE id = $1
+		FOR UPDATE
+	`, id))
+}
+
+func (h *ImageHandler) scanImage(row pgx.Row) (models.Image, error) {
+	var img models.Image
+	err := row.Scan(&img.ID, &img.Title, &img.Tags, &img.Filename, &img.Size,
+		&img.Mime, &img.Checksum, &img.StoragePath, &img.ImageURL,
+		&img.ThumbnailPath, &img.ThumbnailStatus, &img.Metadata,
+		&img.SuggestedTags, &img.RejectedTags, &img.CreatedAt)
+	if h.hideLocation && img.Metadata != nil {
+		img.Metadata.GPS = nil
+	}
+	return img, err
+}
+
+// deleteRenditions removes the rendition rows of an image and returns
+// their storage keys.
+func deleteRenditions(ctx context.Context, tx pgx.Tx, id int64) ([]string, error) {
+	rows, err := tx.Query(ctx,
+		"DELETE FROM image_renditions WHERE image_id = $1 RETURNING storage_key", id)
+	if err != nil {
+		return nil, fmt.Errorf("renditions: %w", err)
+	}
+	keys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("renditions: %w", err)
+	}
+	return keys, nil
+}
+
+// imageID parses the {id} URL parameter and answers 400 if it is invalid.
+func imageID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "invalid image id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
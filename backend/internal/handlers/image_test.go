@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"imageapp/internal/models"
+	"imageapp/internal/services"
+	"imageapp/internal/storage"
+	"imageapp/internal/testdb"
+	"imageapp/internal/ws"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	pgvector "github.com/pgvector/pgvector-go"
+)
+
+var fakeEmbedder = services.NewFakeEmbedder(services.EmbeddingDim)
+
+// testImage describes a processed image row for insertImage.
+type testImage struct {
+	title     string
+	tags      []string
+	createdAt time.Time
+	// embedding and visual default to the fake embedding of the tags
+	embedding []float32
+	visual    []float32
+	suggested []models.SuggestedTag
+}
+
+// insertImage adds a ready image row and returns its id.
+func insertImage(t *testing.T, db *pgxpool.Pool, img testImage) int64 {
+	t.Helper()
+	if img.embedding == nil {
+		img.embedding, _ = fakeEmbedder.EmbedTags(img.tags...)
+	}
+	if img.visual == nil {
+		img.visual = make([]float32, services.ClipDim)
+		copy(img.visual, img.embedding)
+		services.Normalize(img.visual)
+	}
+	if img.createdAt.IsZero() {
+		img.createdAt = time.Now()
+	}
+	if img.suggested == nil {
+		img.suggested = []models.SuggestedTag{}
+	}
+	var id int64
+	err := db.QueryRow(context.Background(), `
+		INSERT INTO images (title, tags, filename, size, mime, checksum, storage_path, image_url,
+		                    embedding, embedding_model, image_embedding, suggested_tags,
+		                    thumbnail_path, thumbnail_status, created_at)
+		VALUES ($1, $2, 'test.png', 1, 'image/png', gen_random_uuid()::text, 'originals/test.png', '/uploads/test.png',
+		        $3, 'fake', $4, $5, 'thumbnails/test.jpg', 'ready', $6)
+		RETURNING id
+	`, img.title, img.tags, pgvector.NewVector(img.embedding), pgvector.NewVector(img.visual),
+		img.suggested, img.createdAt).Scan(&id)
+	if err != nil {
+		t.Fatalf("insert image: %v", err)
+	}
+	return id
+}
+
+func newTestImageHandler(t *testing.T, db *pgxpool.Pool) http.Handler {
+	t.Helper()
+	store, err := storage.NewLocal(t.TempDir(), "/storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := ws.NewHub()
+	go hub.Run()
+	t.Cleanup(hub.Shutdown)
+
+	h := NewImageHandler(db, store, testdb.Models(t, db, fakeEmbedder), hub, nil, false)
+	r := chi.NewRouter()
+	r.Patch("/api/images/{id}", h.Update)
+	r.Post("/api/images/{id}/suggested-tags", h.ReviewSuggestions)
+	return r
+}
+
+func TestUpdateImage(t *testing.T) {
+	db := testdb.New(t)
+	h := newTestImageHandler(t, db)
+	id := insertImage(t, db, testImage{
+		title:     "shore",
+		tags:      []string{"beach"},
+		suggested: []models.SuggestedTag{{Tag: "sky", Confidence: 0.6}, {Tag: "sea", Confidence: 0.3}},
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, "/api/images/"+itoa(id),
+		strings.NewReader(`{"tags": ["beach", "sea"]}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var img models.Image
+	if err := json.NewDecoder(rec.Body).Decode(&img); err != nil {
+		t.Fatal(err)
+	}
+	if len(img.SuggestedTags) != 1 || img.SuggestedTags[0].Tag != "sky" {
+		t.Errorf("suggested %v, want only sky: sea is a tag now", img.SuggestedTags)
+	}
+
+	var embedding pgvector.Vector
+	var tags []string
+	err := db.QueryRow(context.Background(), `
+		SELECT embedding, tags FROM images WHERE id = $1
+	`, id).Scan(&embedding, &tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := fakeEmbedder.EmbedTags("beach", "sea")
+	if !sameVector(embedding.Slice(), want) {
+		t.Error("embedding was not recomputed from the new tags")
+	}
+	if strings.Join(tags, ",") != "beach,sea" {
+		t.Errorf("tags %v", tags)
+	}
+}
+
+func TestUpdateImageErrors(t *testing.T) {
+	db := testdb.New(t)
+	h := newTestImageHandler(t, db)
+	id := insertImage(t, db, testImage{title: "shore", tags: []string{"beach"}})
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{"unknown image", "/api/images/999999", `{"title": "x"}`, http.StatusNotFound},
+		{"invalid id", "/api/images/abc", `{"title": "x"}`, http.StatusBadRequest},
+		{"no tags", "/api/images/" + itoa(id), `{"tags": []}`, http.StatusBadRequest},
+		{"empty title", "/api/images/" + itoa(id), `{"title": " "}`, http.StatusBadRequest},
+		{"invalid body", "/api/images/" + itoa(id), `{`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, tt.path, strings.NewReader(tt.body)))
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d (%s)", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
+
+func itoa(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+func sameVector(a, b []float32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if d := a[i] - b[i]; d > 1e-6 || d < -1e-6 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReviewSuggestions(t *testing.T) {
+	db := testdb.New(t)
+	h := newTestImageHandler(t, db)
+	id := insertImage(t, db, testImage{
+		title: "shore",
+		tags:  []string{"beach"},
+		suggested: []models.SuggestedTag{
+			{Tag: "sky", Confidence: 0.5}, {Tag: "sea", Confidence: 0.3}, {Tag: "sand", Confidence: 0.2},
+		},
+	})
+	review := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/images/"+itoa(id)+"/suggested-tags",
+			strings.NewReader(body)))
+		return rec
+	}
+
+	// accepted and rejected labels match whatever their case
+	rec := review(`{"accept": ["Sea"], "reject": ["SKY"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var img models.Image
+	if err := json.NewDecoder(rec.Body).Decode(&img); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(img.Tags, ",") != "beach,sea" {
+		t.Errorf("tags %v, want beach,sea", img.Tags)
+	}
+	if strings.Join(img.RejectedTags, ",") != "sky" {
+		t.Errorf("rejected %v, want sky", img.RejectedTags)
+	}
+	if len(img.SuggestedTags) != 1 || img.SuggestedTags[0].Tag != "sand" {
+		t.Errorf("suggested %v, want sand", img.SuggestedTags)
+	}
+
+	var rejected []string
+	err := db.QueryRow(context.Background(), "SELECT rejected_tags FROM images WHERE id = $1", id).Scan(&rejected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(rejected, ",") != "sky" {
+		t.Errorf("stored rejections %v, want sky", rejected)
+	}
+
+	// sky is no longer a suggestion
+	if rec := review(`{"accept": ["sky"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("accepting a rejected tag: status %d, want 400", rec.Code)
+	}
+}
+
+// hangUpStore cancels the request as soon as the first blob is deleted,
+// and fails deletes whose context is done, as a remote store would.
+type hangUpStore struct {
+	storage.Storage
+	cancel context.CancelFunc
+}
+
+func (s hangUpStore) Delete(ctx context.Context, key string) error {
+	s.cancel()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Storage.Delete(ctx, key)
+}
+
+// purgedRenders records which images' renders were purged.
+type purgedRenders []int64
+
+func (p *purgedRenders) PurgeImage(id int64) error {
+	*p = append(*p, id)
+	return nil
+}
+
+func TestDeleteImage(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.New(t)
+	store, err := storage.NewLocal(t.TempDir(), "/storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	hub := ws.NewHub()
+	go hub.Run()
+	t.Cleanup(hub.Shutdown)
+	var purged purgedRenders
+	h := NewImageHandler(db, hangUpStore{store, cancel}, testdb.Models(t, db, fakeEmbedder), hub, &purged, false)
+	r := chi.NewRouter()
+	r.Delete("/api/images/{id}", h.Delete)
+
+	id := insertImage(t, db, testImage{title: "doomed", tags: []string{"x"}})
+	keys := []string{"originals/test.png", services.RenditionKey(id, "sq512"), services.RenditionKey(id, "fit640")}
+	for _, key := range keys {
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.Exec(ctx, `
+		INSERT INTO image_renditions (image_id, name, storage_key, width, height)
+		VALUES ($1, 'sq512', $2, 512, 512), ($1, 'fit640', $3, 640, 480)
+	`, id, keys[1], keys[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client hangs up once the row is gone
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequestWithContext(reqCtx, http.MethodDelete, "/api/images/"+itoa(id), nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	for _, key := range keys {
+		if _, err := store.Stat(ctx, key); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("%s left behind: %v", key, err)
+		}
+	}
+	if len(purged) != 1 || purged[0] != id {
+		t.Errorf("purged renders of %v, want %d", purged, id)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/images/"+itoa(id), nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("second delete: status %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// maxEFSearch is the largest hnsw.ef_search pgvector accepts.
+const maxEFSearch = 1000
+
+// sqlArgs collects query arguments and hands out their placeholders.
+type sqlArgs []any
+
+func (a *sqlArgs) add(v any) string {
+	*a = append(*a, v)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+// nearest returns the rows closest to the query vector $1 in column that
+// match filter, ordered by distance and then id, starting after cursor
+// (whose Score is a distance). Score is set to the similarity, sortKey to
+// the distance.
+//
+// ORDER BY is the bare distance, the only order the HNSW index can
+// produce; with iterative scans (pgvector 0.8) it keeps reading until
+// enough rows pass the filter. The id tiebreak is applied here instead:
+// rows are fetched until one is farther than the last of the page, so all
+// rows tied with it are known and the page ends at the same row no matter
+// in which order the index returned them. Past maxEFSearch rows the ties
+// are sorted exactly by the database instead.
+func (h *FeedHandler) nearest(ctx context.Context, column string, args sqlArgs, filter string, cursor *feedCursor, limit int) ([]FeedItem, error) {
+	// column is one of our own column names, never user input
+	if cursor != nil {
+		filter += fmt.Sprintf(" AND (%[1]s <=> $1 > %[2]s OR (%[1]s <=> $1 = %[2]s AND id > %[3]s))",
+			column, args.add(cursor.Score), args.add(cursor.ID))
+	}
+
+	n := limit + 1
+	for {
+		items, err := h.nearestRows(ctx, column, args, filter, nil, n)
+		if err != nil {
+			return nil, err
+		}
+		if len(items) < n || *items[n-1].sortKey > *items[limit-1].sortKey {
+			if len(items) > limit {
+				items = items[:limit]
+			}
+			return items, nil
+		}
+		if n >= maxEFSearch {
+			// too many rows tie with the last of the page, e.g. images with
+			// the same tags; only a full sort finds the lowest ids among them
+			return h.nearestRows(ctx, column, args, filter, items[limit-1].sortKey, limit)
+		}
+		n = min(n*2, maxEFSearch)
+	}
+}
+
+// nearestRows runs one index scan for the n nearest rows and sorts them by
+// distance and id. With maxDistance it sorts every row up to that
+// distance in the database instead, which the index cannot help with.
+func (h *FeedHandler) nearestRows(ctx context.Context, column string, args sqlArgs, filter string, maxDistance *float64, n int) ([]FeedItem, error) {
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	args = append(sqlArgs(nil), args...)
+	order := column + " <=> $1"
+	if maxDistance != nil {
+		filter += fmt.Sprintf(" AND %s <=> $1 <= %s", column, args.add(*maxDistance))
+		order += ", id"
+	} else {
+		// SET LOCAL does not take parameters, set_config(..., true) is the same
+		_, err = tx.Exec(ctx, `
+			SELECT set_config('hnsw.iterative_scan', 'strict_order', true),
+			       set_config('hnsw.ef_search', $1, true)
+		`, strconv.Itoa(min(max(n, 40), maxEFSearch)))
+		if err != nil {
+			return nil, fmt.Errorf("configure index scan: %w", err)
+		}
+	}
+
+	rows, err := tx.Query(ctx, fmt.Sprintf(`
+		SELECT id, title, tags, image_url, thumbnail_path, created_at,
+		       %[1]s <=> $1 AS distance
+		FROM images
+		WHERE thumbnail_status = 'ready'
+		  AND %[1]s IS NOT NULL
+		  AND %[2]s
+		ORDER BY %[3]s
+		LIMIT %[4]s
+	`, column, filter, order, args.add(n)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	items, err := h.scanFeedItemsWithScore(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range items {
+		distance := *items[i].Score
+		similarity := 1 - distance
+		items[i].sortKey = &distance
+		items[i].Score = &similarity
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if *items[i].sortKey != *items[j].sortKey {
+			return *items[i].sortKey < *items[j].sortKey
+		}
+		return items[i].ID < items[j].ID
+	})
+	return items, tx.Commit(ctx)
+}
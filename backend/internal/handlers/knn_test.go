@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"imageapp/internal/testdb"
+
+	pgvector "github.com/pgvector/pgvector-go"
+)
+
+func TestNearestManyTies(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.New(t)
+	h := NewFeedHandler(db, nil, nil, nil, nil, nil, FeedConfig{CursorKey: "test"})
+
+	// two exact matches, then more rows at one distance than a single
+	// index scan may return
+	closest := []int64{
+		insertImage(t, db, testImage{title: "a", tags: []string{"beach"}}),
+		insertImage(t, db, testImage{title: "b", tags: []string{"beach"}}),
+	}
+	tied, _ := fakeEmbedder.EmbedTags("sunset")
+	rows, err := db.Query(ctx, `
+		INSERT INTO images (title, tags, filename, size, mime, checksum, storage_path, image_url,
+		                    embedding, embedding_model, thumbnail_path, thumbnail_status)
+		SELECT 'tied', '{sunset}', 'test.png', 1, 'image/png', gen_random_uuid()::text,
+		       'originals/test.png', '/uploads/test.png', $1, 'fake', 'thumbnails/test.jpg', 'ready'
+		FROM generate_series(1, $2)
+		RETURNING id
+	`, pgvector.NewVector(tied), maxEFSearch+50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tiedIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		tiedIDs = append(tiedIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(tiedIDs)
+
+	query, _ := fakeEmbedder.EmbedTags("beach")
+	want := append(closest, tiedIDs[:13]...)
+	var got []int64
+	var cursor *feedCursor
+	for len(got) < len(want) {
+		items, err := h.nearest(ctx, "embedding", sqlArgs{pgvector.NewVector(query)}, "TRUE", cursor, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 5 {
+			t.Fatalf("page of %d items, want 5", len(items))
+		}
+		for _, item := range items {
+			got = append(got, item.ID)
+		}
+		last := items[len(items)-1]
+		cursor = &feedCursor{Score: *last.sortKey, ID: last.ID}
+	}
+	if !slices.Equal(got[:len(want)], want) {
+		t.Errorf("pages give %v, want %v", got[:len(want)], want)
+	}
+}
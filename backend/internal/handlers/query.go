@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxTermWeight bounds term^weight, so one term cannot drown the others.
+const maxTermWeight = 10
+
+// QueryTerm is one part of a filter. Negative terms exclude images that
+// would match them on their own; the others are embedded and combined
+// according to their weight.
+type QueryTerm struct {
+	Text     string  `json:"text"`
+	Weight   float64 `json:"weight"`
+	Negative bool    `json:"negative,omitempty"`
+	phrase   bool    // was quoted
+}
+
+// ParsedQuery is a filter split into terms.
+type ParsedQuery struct {
+	Terms []QueryTerm `json:"terms"`
+}
+
+// parseQuery splits a filter like `beach^2 "golden hour" -people` into
+// terms. A leading - negates a term, a trailing ^n with a number n
+// weights it (any other ^ is part of the text) and double quotes group
+// words. Consecutive plain words stay one term, so "red car at night" is
+// embedded as a whole, as before.
+func parseQuery(filter string) (ParsedQuery, error) {
+	var q ParsedQuery
+	var plain []string
+	flush := func() {
+		if len(plain) > 0 {
+			q.Terms = append(q.Terms, QueryTerm{Text: strings.Join(plain, " "), Weight: 1})
+			plain = nil
+		}
+	}
+
+	for _, token := range splitQuery(filter) {
+		term := QueryTerm{Weight: 1}
+		if len(token) > 1 && token[0] == '-' {
+			term.Negative = true
+			token = token[1:]
+		}
+
+		weighted := false
+		i := strings.LastIndexByte(token, '^')
+		if w, ok := parseWeight(token[i+1:]); i > strings.LastIndexByte(token, '"') && ok {
+			if w <= 0 || w > maxTermWeight {
+				return ParsedQuery{}, fmt.Errorf("invalid weight in %q, must be a number above 0 and up to %d", token, maxTermWeight)
+			}
+			if term.Negative {
+				return ParsedQuery{}, fmt.Errorf("negative term %q cannot have a weight", token)
+			}
+			term.Weight, weighted = w, true
+			token = token[:i]
+		}
+
+		term.phrase = strings.Contains(token, `"`)
+		term.Text = strings.Join(strings.Fields(strings.ReplaceAll(token, `"`, " ")), " ")
+		if term.Text == "" {
+			continue
+		}
+		if !term.Negative && !weighted && !term.phrase {
+			plain = append(plain, term.Text)
+			continue
+		}
+		flush()
+		q.Terms = append(q.Terms, term)
+	}
+	flush()
+
+	if len(q.Positive()) == 0 {
+		return ParsedQuery{}, errors.New("filter needs at least one term that is not negated")
+	}
+	return q, nil
+}
+
+// parseWeight reads the n of term^n. It only accepts plain decimal
+// numbers, anything else is not a weight.
+func parseWeight(s string) (float64, bool) {
+	if s == "" || strings.Trim(s, "0123456789.") != "" {
+		return 0, false
+	}
+	w, err := strconv.ParseFloat(s, 64)
+	return w, err == nil
+}
+
+// splitQuery splits at whitespace outside of double quotes.
+func splitQuery(s string) []string {
+	var tokens []string
+	var current strings.Builder
+	inQuote := false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			current.WriteRune(r)
+		case unicode.IsSpace(r) && !inQuote:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+func (q ParsedQuery) Positive() []QueryTerm {
+	var terms []QueryTerm
+	for _, t := range q.Terms {
+		if !t.Negative {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+func (q ParsedQuery) Negative() []QueryTerm {
+	var terms []QueryTerm
+	for _, t := range q.Terms {
+		if t.Negative {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// key identifies the query in cursors: a hash of its terms that is the
+// same for filters differing only in case or spacing.
+func (q ParsedQuery) key() string {
+	h := sha256.New()
+	for _, t := range q.Terms {
+		fmt.Fprintf(h, "%t %t %g %s\x00", t.Negative, t.phrase, t.Weight, strings.ToLower(t.Text))
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:12])
+}
+
+// Text is the positive terms as plain text, for the cross-encoder.
+func (q ParsedQuery) Text() string {
+	var parts []string
+	for _, t := range q.Positive() {
+		parts = append(parts, t.Text)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Lexical renders the query in websearch_to_tsquery syntax, which knows
+// quotes and - but not weights.
+func (q ParsedQuery) Lexical() string {
+	parts := make([]string, len(q.Terms))
+	for i, t := range q.Terms {
+		text := t.Text
+		if t.phrase {
+			text = `"` + text + `"`
+		}
+		if t.Negative {
+			text = "-" + text
+		}
+		parts[i] = text
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   []QueryTerm
+	}{
+		{"red car at night", []QueryTerm{{Text: "red car at night", Weight: 1}}},
+		{"beach^2 sunset", []QueryTerm{{Text: "beach", Weight: 2}, {Text: "sunset", Weight: 1}}},
+		{"beach^0.5", []QueryTerm{{Text: "beach", Weight: 0.5}}},
+		{"a^b", []QueryTerm{{Text: "a^b", Weight: 1}}},
+		{"c^", []QueryTerm{{Text: "c^", Weight: 1}}},
+		{"x^-1", []QueryTerm{{Text: "x^-1", Weight: 1}}},
+		{"v^1.2.3", []QueryTerm{{Text: "v^1.2.3", Weight: 1}}},
+		{"beach -people", []QueryTerm{{Text: "beach", Weight: 1}, {Text: "people", Weight: 1, Negative: true}}},
+		{`"golden hour"^3`, []QueryTerm{{Text: "golden hour", Weight: 3, phrase: true}}},
+		{`"a^2"`, []QueryTerm{{Text: "a^2", Weight: 1, phrase: true}}},
+	}
+	for _, tt := range tests {
+		q, err := parseQuery(tt.filter)
+		if err != nil {
+			t.Errorf("%q: %v", tt.filter, err)
+			continue
+		}
+		if !reflect.DeepEqual(q.Terms, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.filter, q.Terms, tt.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, filter := range []string{"cat^0", "cat^11", "beach -people^2", "-cat", ""} {
+		if q, err := parseQuery(filter); err == nil {
+			t.Errorf("%q: no error, got %+v", filter, q.Terms)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"imageapp/internal/services"
+	"imageapp/internal/storage"
+
+	"github.com/disintegration/imaging"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/sync/singleflight"
+)
+
+const maxRenderSize = 4096
+
+// renderTimeout bounds one render. It does not depend on the request that
+// started it, the result is shared with everyone waiting for it.
+const renderTimeout = time.Minute
+
+type renderParams struct {
+	Width   int
+	Height  int
+	Fit     string // fill, fit
+	Format  string // jpeg, png
+	Quality int
+}
+
+// RenderHandler resizes originals on request and caches the result on disk.
+// To keep the cache bounded, callers either pick one of the presets or send
+// arbitrary parameters together with an HMAC signature. Entries live in
+// one directory per image, so they go away with the image; Evict caps the
+// total size.
+type RenderHandler struct {
+	db         services.DB
+	store      storage.Storage
+	cacheDir   string
+	presets    map[string]services.Rendition
+	signingKey []byte
+	maxPixels  int
+	group      singleflight.Group
+}
+
+func NewRenderHandler(db services.DB, store storage.Storage, cacheDir string, presets []services.Rendition, signingKey string, maxPixels int) (*RenderHandler, error) {
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create render cache dir: %w", err)
+	}
+
+	byName := make(map[string]services.Rendition, len(presets))
+	for _, p := range presets {
+		byName[p.Name] = p
+	}
+
+	return &RenderHandler{
+		db:         db,
+		store:      store,
+		cacheDir:   cacheDir,
+		presets:    byName,
+		signingKey: []byte(signingKey),
+		maxPixels:  maxPixels,
+	}, nil
+}
+
+// Render serves GET /api/images/{id}/render?preset= or
+// ?w=&h=&fit=&format=&q=&sig=.
+func (h *RenderHandler) Render(w http.ResponseWriter, r *http.Request) {
+	id, ok := imageID(w, r)
+	if !ok {
+		return
+	}
+
+	params, err := h.parseParams(id, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var storageKey, checksum string
+	err = h.db.QueryRow(r.Context(),
+		"SELECT storage_path, checksum FROM images WHERE id = $1", id,
+	).Scan(&storageKey, &checksum)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "image not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Render error: %v", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	// the checksum pins the cache entry to the original's content, so an
+	// entry never goes stale and can be cached by clients forever
+	sum := sha256.Sum256([]byte(checksum + "|" + params.canonical(id)))
+	etag := hex.EncodeToString(sum[:16])
+	cachePath := filepath.Join(h.imageCacheDir(id), etag+"."+params.Format)
+
+	if _, err := os.Stat(cachePath); err != nil {
+		_, err, _ = h.group.Do(cachePath, func() (any, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), renderTimeout)
+			defer cancel()
+			return nil, h.render(ctx, storageKey, params, cachePath)
+		})
+		if errors.Is(err, services.ErrInvalidImage) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			log.Printf("Render error for image %d: %v", id, err)
+			http.Error(w, "render failed", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	f, err := os.Open(cachePath)
+	if err != nil {
+		log.Printf("Render error for image %d: %v", id, err)
+		http.Error(w, "render failed", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, "render failed", http.StatusInternalServerError)
+		return
+	}
+	// the access time for Evict; many filesystems do not keep atime
+	now := time.Now()
+	os.Chtimes(cachePath, now, now)
+
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Content-Type", "image/"+params.Format)
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// PurgeImage removes the cached renders of an image.
+func (h *RenderHandler) PurgeImage(id int64) error {
+	return os.RemoveAll(h.imageCacheDir(id))
+}
+
+// Evict removes the least recently served renders until the cache takes at
+// most maxBytes.
+func (h *RenderHandler) Evict(maxBytes int64) error {
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []entry
+	var total int64
+	err := filepath.WalkDir(h.cacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// removed meanwhile, e.g. by PurgeImage
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, entry{path, fi.Size(), fi.ModTime()})
+		total += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("scan render cache: %w", err)
+	}
+
+	slices.SortFunc(entries, func(a, b entry) int { return a.modTime.Compare(b.modTime) })
+	for _, e := range entries {
+		if total <= maxBytes {
+			break
+		}
+		if err := os.Remove(e.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		total -= e.size
+	}
+	return nil
+}
+
+func (h *RenderHandler) imageCacheDir(id int64) string {
+	return filepath.Join(h.cacheDir, strconv.FormatInt(id, 10))
+}
+
+func (h *RenderHandler) render(ctx context.Context, storageKey string, params renderParams, cachePath string) error {
+	obj, err := h.store.Get(ctx, storageKey)
+	if err != nil {
+		return fmt.Errorf("open image: %w", err)
+	}
+	defer obj.Close()
+
+	src, err := services.DecodeImage(obj, h.maxPixels)
+	if err != nil {
+		return err
+	}
+
+	var img image.Image
+	switch params.Fit {
+	case "fill":
+		img = imaging.Fill(src, params.Width, params.Height, imaging.Center, imaging.Lanczos)
+	default:
+		width, height := params.Width, params.Height
+		if width == 0 {
+			width = src.Bounds().Dx()
+		}
+		if height == 0 {
+			height = src.Bounds().Dy()
+		}
+		img = imaging.Fit(src, width, height, imaging.Lanczos)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), ".render-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	format := imaging.JPEG
+	if params.Format == "png" {
+		format = imaging.PNG
+	}
+	err = imaging.Encode(tmp, img, format, imaging.JPEGQuality(params.Quality))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	return os.Rename(tmp.Name(), cachePath)
+}
+
+func (h *RenderHandler) parseParams(id int64, r *http.Request) (renderParams, error) {
+	q := r.URL.Query()
+
+	if name := q.Get("preset"); name != "" {
+		preset, ok := h.presets[name]
+		if !ok {
+			return renderParams{}, fmt.Errorf("unknown preset %q", name)
+		}
+		return renderParams{
+			Width:   preset.Width,
+			Height:  preset.Height,
+			Fit:     preset.Mode,
+			Format:  "jpeg",
+			Quality: 80,
+		}, nil
+	}
+
+	if len(h.signingKey) == 0 {
+		return renderParams{}, fmt.Errorf("preset is required")
+	}
+
+	params := renderParams{Fit: "fit", Format: "jpeg", Quality: 80}
+	var err error
+	if params.Width, err = intParam(q.Get("w"), 0, maxRenderSize); err != nil {
+		return params, fmt.Errorf("invalid w")
+	}
+	if params.Height, err = intParam(q.Get("h"), 0, maxRenderSize); err != nil {
+		return params, fmt.Errorf("invalid h")
+	}
+	if v := q.Get("fit"); v != "" {
+		params.Fit = v
+	}
+	if v := q.Get("format"); v != "" {
+		params.Format = v
+	}
+	if v := q.Get("q"); v != "" {
+		if params.Quality, err = intParam(v, 1, 100); err != nil {
+			return params, fmt.Errorf("invalid q")
+		}
+	}
+
+	if params.Fit != "fill" && params.Fit != "fit" {
+		return params, fmt.Errorf("fit must be fill or fit")
+	}
+	if params.Format != "jpeg" && params.Format != "png" {
+		return params, fmt.Errorf("format must be jpeg or png")
+	}
+	if params.Width == 0 && params.Height == 0 {
+		return params, fmt.Errorf("w or h is required")
+	}
+	if params.Fit == "fill" && (params.Width == 0 || params.Height == 0) {
+		return params, fmt.Errorf("fill needs both w and h")
+	}
+
+	sig, err := hex.DecodeString(q.Get("sig"))
+	if err != nil || !hmac.Equal(sig, signRender(h.signingKey, id, params)) {
+		return params, fmt.Errorf("invalid signature")
+	}
+	return params, nil
+}
+
+// signRender is HMAC-SHA256 over "id:w:h:fit:format:q"; the sig query
+// parameter is its hex encoding.
+func signRender(key []byte, id int64, params renderParams) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(params.canonical(id)))
+	return mac.Sum(nil)
+}
+
+func (p renderParams) canonical(id int64) string {
+	return fmt.Sprintf("%d:%d:%d:%s:%s:%d", id, p.Width, p.Height, p.Fit, p.Format, p.Quality)
+}
+
+func intParam(v string, lo, hi int) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < lo || n > hi {
+		return 0, fmt.Errorf("out of range")
+	}
+	return n, nil
+}
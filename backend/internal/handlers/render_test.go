@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRenderCacheEvictAndPurge(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewRenderHandler(nil, nil, dir, nil, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// three 100-byte renders of image 1 served at different times, one of image 2
+	old := time.Now().Add(-time.Hour)
+	files := []struct {
+		id   int64
+		name string
+		age  time.Duration
+	}{
+		{1, "a.jpeg", 3 * time.Minute},
+		{1, "b.jpeg", 2 * time.Minute},
+		{1, "c.jpeg", time.Minute},
+		{2, "d.jpeg", 0},
+	}
+	for _, f := range files {
+		path := filepath.Join(h.imageCacheDir(f.id), f.name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, 100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := old.Add(-f.age)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := h.Evict(250); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(h.imageCacheDir(f.id), f.name))
+		evicted := f.name == "a.jpeg" || f.name == "b.jpeg"
+		if evicted != os.IsNotExist(err) {
+			t.Errorf("%s: evicted %v, want %v", f.name, os.IsNotExist(err), evicted)
+		}
+	}
+
+	if err := h.PurgeImage(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(h.imageCacheDir(1)); !os.IsNotExist(err) {
+		t.Errorf("renders of image 1 still cached after purge")
+	}
+	if _, err := os.Stat(filepath.Join(h.imageCacheDir(2), "d.jpeg")); err != nil {
+		t.Errorf("purge of image 1 removed image 2: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// rerankCacheSize is how many scored windows are kept, rerankCacheTTL how
+// long a window serves further pages.
+const (
+	rerankCacheSize = 64
+	rerankCacheTTL  = 5 * time.Minute
+)
+
+// rerankedFeed takes the top candidates of the vector search and orders
+// them by the cross-encoder's score for filter against title and tags. The
+// results are paged within the candidate window, like hybrid search. The
+// first page scores the window, later pages are cut from it as long as it
+// is cached; kind identifies the query, as in cursors.
+func (h *FeedHandler) rerankedFeed(ctx context.Context, filter, kind string, space searchSpace, cursor *feedCursor, limit int) ([]FeedItem, error) {
+	key := fmt.Sprintf("%s:%g", kind, space.minScore)
+	items, ok := h.reranks.get(key)
+	if cursor == nil || !ok {
+		// concurrent requests for the same window score it once
+		v, err, _ := h.reranks.group.Do(key, func() (any, error) {
+			items, err := h.scoreWindow(context.WithoutCancel(ctx), filter, space)
+			if err != nil {
+				return nil, err
+			}
+			h.reranks.put(key, items)
+			return items, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		items = v.([]FeedItem)
+	}
+
+	if cursor != nil {
+		i := sort.Search(len(items), func(i int) bool {
+			score := *items[i].Score
+			return score < cursor.Score || (score == cursor.Score && items[i].ID > cursor.ID)
+		})
+		items = items[i:]
+	}
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	// the window is shared, the page gets its renditions attached
+	return slices.Clone(items), nil
+}
+
+// scoreWindow returns the candidates of the vector search ordered by
+// relevance.
+func (h *FeedHandler) scoreWindow(ctx context.Context, filter string, space searchSpace) ([]FeedItem, error) {
+	items, err := h.filteredFeed(ctx, space, nil, h.config.RerankCandidates)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+
+	docs := make([]string, len(items))
+	for i, item := range items {
+		docs[i] = item.Title + ". " + strings.Join(item.Tags, " ")
+	}
+	scores, err := h.reranker.Score(filter, docs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range items {
+		items[i].Score = &scores[i]
+		// pages are positioned by the relevance, not the distance
+		items[i].sortKey = nil
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if *items[i].Score != *items[j].Score {
+			return *items[i].Score > *items[j].Score
+		}
+		return items[i].ID < items[j].ID
+	})
+	return items, nil
+}
+
+// rerankCache keeps the scored windows of recent re-ranked searches, the
+// least recently used one is evicted once rerankCacheSize is reached.
+type rerankCache struct {
+	mu    sync.Mutex
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+	group singleflight.Group
+}
+
+type rerankWindow struct {
+	key    string
+	items  []FeedItem
+	scored time.Time
+}
+
+func newRerankCache() *rerankCache {
+	return &rerankCache{
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *rerankCache) get(key string) ([]FeedItem, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	window := el.Value.(*rerankWindow)
+	if time.Since(window.scored) > rerankCacheTTL {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return window.items, true
+}
+
+func (c *rerankCache) put(key string, items []FeedItem) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		window := el.Value.(*rerankWindow)
+		window.items, window.scored = items, time.Now()
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&rerankWindow{key: key, items: items, scored: time.Now()})
+	for c.order.Len() > rerankCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*rerankWindow).key)
+	}
+}
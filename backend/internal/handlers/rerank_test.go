@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"imageapp/internal/services"
+	"imageapp/internal/storage"
+	"imageapp/internal/testdb"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// wordReranker scores documents by how often word occurs in them and
+// counts the batches it scored.
+type wordReranker struct {
+	word  string
+	calls atomic.Int64
+}
+
+func (r *wordReranker) Score(_ string, docs []string) ([]float64, error) {
+	r.calls.Add(1)
+	scores := make([]float64, len(docs))
+	for i, doc := range docs {
+		scores[i] = float64(strings.Count(doc, r.word)) / 10
+	}
+	return scores, nil
+}
+
+func TestRerankedFeed(t *testing.T) {
+	db := testdb.New(t)
+	store, err := storage.NewLocal(t.TempDir(), "/storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reranker := &wordReranker{word: "sunset"}
+	h := NewFeedHandler(db, store, testdb.Models(t, db, fakeEmbedder), nil,
+		services.NewQueryCache(16), reranker, FeedConfig{
+			RerankCandidates: 50,
+			CursorKey:        "test",
+		})
+	r := chi.NewRouter()
+	r.Get("/api/feed", h.Feed)
+
+	// the vector search ranks plain beach photos first, the cross-encoder
+	// prefers the sunsets
+	var plain, sunsets []int64
+	for range 4 {
+		plain = append(plain, insertImage(t, db, testImage{title: "photo", tags: []string{"beach"}}))
+	}
+	for range 3 {
+		sunsets = append(sunsets, insertImage(t, db, testImage{title: "sunset", tags: []string{"beach", "sunset"}}))
+	}
+
+	query := url.Values{"filter": {"beach"}, "rerank": {"true"}}
+	full := pageThrough(t, r, "/api/feed", query, 50)
+	if want := append(slices.Clone(sunsets), plain...); !slices.Equal(pageIDs(full), want) {
+		t.Fatalf("served %v, want %v", pageIDs(full), want)
+	}
+	for i := 1; i < len(full); i++ {
+		if !servedInOrder("rerank", full[i-1], full[i]) {
+			t.Errorf("out of order at %d: %+v before %+v", i, full[i-1], full[i])
+		}
+	}
+
+	paged := pageThrough(t, r, "/api/feed", query, 2)
+	if !slices.Equal(pageIDs(paged), pageIDs(full)) {
+		t.Errorf("pages give %v, want %v", pageIDs(paged), pageIDs(full))
+	}
+	// one scoring per first page, later pages reuse it
+	if n := reranker.calls.Load(); n != 2 {
+		t.Errorf("scored %d times for two first pages", n)
+	}
+}
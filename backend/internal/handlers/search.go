@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"imageapp/internal/services"
+)
+
+// SearchByImage serves POST /api/search/by-image: the multipart "image"
+// field is embedded with the CLIP image encoder and compared with the
+// stored content embeddings. Nothing is written to storage or the images
+// table. Optional form fields: limit and min_score.
+func (h *FeedHandler) SearchByImage(w http.ResponseWriter, r *http.Request) {
+	if h.clip == nil {
+		http.Error(w, "visual search is not enabled", http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "invalid multipart form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := parseLimit(r)
+	minScore := 0.0
+	var src *spooledFile
+	defer func() {
+		if src != nil {
+			src.remove()
+		}
+	}()
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			uploadReadError(w, err)
+			return
+		}
+
+		var value string
+		switch part.FormName() {
+		case "image":
+			if src == nil {
+				src, err = spoolToTemp(part)
+			}
+		case "limit":
+			if value, err = readField(part); err == nil {
+				if l, convErr := strconv.Atoi(value); convErr == nil && l > 0 && l <= 50 {
+					limit = l
+				}
+			}
+		case "min_score":
+			if value, err = readField(part); err == nil {
+				var convErr error
+				if minScore, convErr = strconv.ParseFloat(value, 64); convErr != nil {
+					part.Close()
+					http.Error(w, "invalid min_score", http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		part.Close()
+		if err != nil {
+			uploadReadError(w, err)
+			return
+		}
+	}
+
+	if src == nil {
+		http.Error(w, "missing image field", http.StatusBadRequest)
+		return
+	}
+
+	vec, err := h.embedQueryImage(src)
+	if errors.Is(err, services.ErrInvalidImage) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		log.Printf("Search by image error: %v", err)
+		http.Error(w, "embedding failed", http.StatusInternalServerError)
+		return
+	}
+
+	space := searchSpace{column: "image_embedding", vector: vec, minScore: minScore}
+	items, err := h.filteredFeed(r.Context(), space, nil, limit)
+	if err == nil {
+		err = h.attachRenditions(r.Context(), items)
+	}
+	if err != nil {
+		log.Printf("Search by image error: %v", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"items": items,
+	})
+}
+
+func (h *FeedHandler) embedQueryImage(src *spooledFile) ([]float32, error) {
+	f, err := os.Open(src.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, err := services.DecodeImage(f, h.config.MaxPixels)
+	if err != nil {
+		return nil, err
+	}
+	return h.clip.EmbedImage(img)
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSearchByImageInvalidMinScore(t *testing.T) {
+	h := NewFeedHandler(nil, nil, nil, fakeVisual{}, nil, nil, FeedConfig{CursorKey: "test"})
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("min_score", "high")
+	part, _ := mw.CreateFormFile("image", "query.png")
+	part.Write([]byte("not read"))
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/search/by-image", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	h.SearchByImage(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", rec.Code)
+	}
+	if msg := strings.TrimSpace(rec.Body.String()); msg != "invalid min_score" {
+		t.Errorf("message %q, want invalid min_score", msg)
+	}
+}
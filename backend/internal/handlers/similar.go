@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	pgvector "github.com/pgvector/pgvector-go"
+)
+
+// Similar serves GET /api/images/{id}/similar: the nearest neighbours of an
+// image's stored embedding, found through the HNSW index.
+//
+// Query parameters: exclude_self (default true), min_score, limit, cursor
+// and search ("tags" compares tag embeddings, "visual" content embeddings).
+func (h *FeedHandler) Similar(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, ok := imageID(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	limit := parseLimit(r)
+	search, ok := h.parseSearch(w, r)
+	if !ok {
+		return
+	}
+	excludeSelf := q.Get("exclude_self") != "false"
+
+	minScore := -1.0
+	if v := q.Get("min_score"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, "invalid min_score", http.StatusBadRequest)
+			return
+		}
+		minScore = f
+	}
+
+	column := "embedding"
+	if search == "visual" {
+		column = "image_embedding"
+	}
+
+	// the cursor holds the distance and id of the last item of the previous
+	// page and is bound to the source image and search space
+	kind := fmt.Sprintf("similar:%s:%d", search, id)
+	cursor, err := decodeCursor(h.cursorKey, q.Get("cursor"), kind)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var source *pgvector.Vector
+	err = h.db.QueryRow(ctx, fmt.Sprintf(`
+		SELECT %s FROM images WHERE id = $1 AND thumbnail_status = 'ready'
+	`, column), id).Scan(&source)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && source == nil) {
+		http.Error(w, "image not found or not processed yet", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Similar error: %v", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	args := sqlArgs{*source}
+	filter := fmt.Sprintf("NOT (%s AND id = %s) AND 1 - (%s <=> $1) >= %s",
+		args.add(excludeSelf), args.add(id), column, args.add(minScore))
+	items, err := h.nearest(ctx, column, args, filter, cursor, limit)
+	if err != nil {
+		log.Printf("Similar error: %v", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.attachRenditions(ctx, items); err != nil {
+		log.Printf("Similar error: %v", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	var nextCursor string
+	if len(items) == limit {
+		last := items[len(items)-1]
+		nextCursor = encodeCursor(h.cursorKey, feedCursor{Kind: kind, Score: *last.sortKey, ID: last.ID})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"items":       items,
+		"next_cursor": nextCursor,
+		"source_id":   id,
+		"search":      search,
+	})
+}
@@ -0,0 +1,400 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const tusVersion = "1.0.0"
+
+// tusUpload is the state of one resumable upload. The received bytes live
+// in <id>.bin next to it; the file size is the current offset.
+type tusUpload struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// TusHandler implements the core tus protocol plus the creation and
+// termination extensions (https://tus.io/protocols/resumable-upload).
+// Finished uploads go through the same path as UploadHandler.Upload.
+type TusHandler struct {
+	dir      string
+	basePath string
+	uploader *UploadHandler
+
+	mu    sync.Mutex
+	locks map[string]*uploadLock // upload id -> lock, while held or waited for
+}
+
+// uploadLock serializes the requests on one upload. refs counts holders
+// and waiters; the last one out removes it from TusHandler.locks.
+type uploadLock struct {
+	sync.Mutex
+	refs int
+}
+
+func NewTusHandler(dir, basePath string, uploader *UploadHandler) (*TusHandler, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create tus dir: %w", err)
+	}
+	return &TusHandler{
+		dir:      dir,
+		basePath: strings.TrimSuffix(basePath, "/"),
+		uploader: uploader,
+		locks:    make(map[string]*uploadLock),
+	}, nil
+}
+
+func (h *TusHandler) Options(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination")
+	w.Header().Set("Tus-Max-Size", strconv.Itoa(maxUploadSize))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Create registers a new upload. Title, tags (a JSON array), filename and
+// filetype come in Upload-Metadata and are checked here, so the client
+// does not send megabytes only to be rejected at the end.
+func (h *TusHandler) Create(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if !tusResumable(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > maxUploadSize {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if meta["title"] == "" {
+		http.Error(w, "title is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := tusTags(meta); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !isAllowedMime(meta["filetype"]) {
+		http.Error(w, "unsupported image format", http.StatusBadRequest)
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+	upload := tusUpload{
+		ID:        hex.EncodeToString(idBytes),
+		Length:    length,
+		Metadata:  meta,
+		CreatedAt: time.Now(),
+	}
+
+	info, err := json.Marshal(upload)
+	if err == nil {
+		err = os.WriteFile(h.infoPath(upload.ID), info, 0o644)
+	}
+	if err == nil {
+		err = os.WriteFile(h.dataPath(upload.ID), nil, 0o644)
+	}
+	if err != nil {
+		log.Printf("tus create: %v", err)
+		h.removeUpload(upload.ID)
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", h.basePath+"/"+upload.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *TusHandler) Head(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+
+	upload, offset, ok := h.loadUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// Patch appends a chunk at Upload-Offset. Bytes received before a dropped
+// connection are kept, so the client resumes from the offset HEAD reports.
+// The last chunk triggers the checksum/dedupe/insert/queue step.
+func (h *TusHandler) Patch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if !tusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// unknown ids are answered before they get a lock
+	if _, _, ok := h.loadUpload(w, r); !ok {
+		return
+	}
+	id := chi.URLParam(r, "uploadID")
+	defer h.lock(id)()
+
+	// again under the lock, another request may have moved it on
+	upload, offset, ok := h.loadUpload(w, r)
+	if !ok {
+		return
+	}
+
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if clientOffset != offset {
+		http.Error(w, "offset mismatch", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(h.dataPath(id), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		log.Printf("tus patch %s: %v", id, err)
+		http.Error(w, "failed to open upload", http.StatusInternalServerError)
+		return
+	}
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.Length-offset))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	offset += n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	if copyErr != nil {
+		log.Printf("tus patch %s: stopped at offset %d: %v", id, offset, copyErr)
+		http.Error(w, "failed to write chunk", http.StatusInternalServerError)
+		return
+	}
+
+	if offset == upload.Length {
+		result, err := h.finish(r, upload)
+		if err != nil {
+			processUploadError(w, err)
+			return
+		}
+		w.Header().Set("Image-Id", fmt.Sprint(result["id"]))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *TusHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if !tusResumable(w, r) {
+		return
+	}
+
+	if _, _, ok := h.loadUpload(w, r); !ok {
+		return
+	}
+	id := chi.URLParam(r, "uploadID")
+	defer h.lock(id)()
+
+	if _, _, ok := h.loadUpload(w, r); !ok {
+		return
+	}
+	h.removeUpload(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeExpired removes unfinished uploads that received no data for maxAge.
+func (h *TusHandler) PurgeExpired(maxAge time.Duration) {
+	infos, err := filepath.Glob(filepath.Join(h.dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, path := range infos {
+		id := strings.TrimSuffix(filepath.Base(path), ".json")
+		if !h.expired(id, maxAge) {
+			continue
+		}
+		// a PATCH may have been writing meanwhile, look again under its lock
+		unlock := h.lock(id)
+		expired := h.expired(id, maxAge)
+		if expired {
+			h.removeUpload(id)
+		}
+		unlock()
+		if expired {
+			log.Printf("tus: removed expired upload %s", id)
+		}
+	}
+}
+
+// expired reports whether the upload still exists and received no data
+// for maxAge.
+func (h *TusHandler) expired(id string, maxAge time.Duration) bool {
+	if _, err := os.Stat(h.infoPath(id)); err != nil {
+		return false
+	}
+	fi, err := os.Stat(h.dataPath(id))
+	return err != nil || time.Since(fi.ModTime()) >= maxAge
+}
+
+// finish hands the assembled file to processUpload and drops the upload
+// state either way; a failed upload has to be started again.
+func (h *TusHandler) finish(r *http.Request, upload tusUpload) (map[string]any, error) {
+	defer h.removeUpload(upload.ID)
+
+	src, err := hashFile(h.dataPath(upload.ID))
+	if err != nil {
+		return nil, fmt.Errorf("read upload: %w", err)
+	}
+	defer src.remove()
+
+	tags, _ := tusTags(upload.Metadata)
+	filename := upload.Metadata["filename"]
+	if filename == "" {
+		filename = upload.ID
+	}
+
+	return h.uploader.processUpload(r.Context(), src, filename,
+		upload.Metadata["filetype"], upload.Metadata["title"], tags)
+}
+
+// loadUpload reads the upload named in the URL together with its current
+// offset, answering 404 if it does not exist.
+func (h *TusHandler) loadUpload(w http.ResponseWriter, r *http.Request) (tusUpload, int64, bool) {
+	var upload tusUpload
+	id := chi.URLParam(r, "uploadID")
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		http.NotFound(w, r)
+		return upload, 0, false
+	}
+
+	info, err := os.ReadFile(h.infoPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return upload, 0, false
+	}
+	if err == nil {
+		err = json.Unmarshal(info, &upload)
+	}
+	if err != nil {
+		log.Printf("tus load %s: %v", id, err)
+		http.Error(w, "failed to read upload", http.StatusInternalServerError)
+		return upload, 0, false
+	}
+
+	fi, err := os.Stat(h.dataPath(id))
+	if err != nil {
+		log.Printf("tus load %s: %v", id, err)
+		http.Error(w, "failed to read upload", http.StatusInternalServerError)
+		return upload, 0, false
+	}
+	return upload, fi.Size(), true
+}
+
+func (h *TusHandler) removeUpload(id string) {
+	os.Remove(h.dataPath(id))
+	os.Remove(h.infoPath(id))
+}
+
+// lock takes the lock of one upload and returns the function that
+// releases it. The entry is dropped when nobody holds or waits for it
+// any more, never while another request could still get it.
+func (h *TusHandler) lock(id string) (unlock func()) {
+	h.mu.Lock()
+	l := h.locks[id]
+	if l == nil {
+		l = &uploadLock{}
+		h.locks[id] = l
+	}
+	l.refs++
+	h.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		h.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(h.locks, id)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *TusHandler) dataPath(id string) string {
+	return filepath.Join(h.dir, id+".bin")
+}
+
+func (h *TusHandler) infoPath(id string) string {
+	return filepath.Join(h.dir, id+".json")
+}
+
+func tusResumable(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2".
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if header == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || key == "" {
+			return nil, fmt.Errorf("invalid Upload-Metadata")
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
+
+func tusTags(meta map[string]string) ([]string, error) {
+	var tags []string
+	if meta["tags"] != "" {
+		if err := json.Unmarshal([]byte(meta["tags"]), &tags); err != nil {
+			return nil, fmt.Errorf("invalid tags format")
+		}
+	}
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("at least one tag is required")
+	}
+	return tags, nil
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestTusLock(t *testing.T) {
+	h, err := NewTusHandler(t.TempDir(), "/api/uploads", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	inside := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := h.lock("abcd")
+			mu.Lock()
+			inside++
+			if inside > 1 {
+				t.Error("two holders of one upload lock")
+			}
+			mu.Unlock()
+
+			mu.Lock()
+			inside--
+			mu.Unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(h.locks) != 0 {
+		t.Errorf("%d locks left after all holders released them", len(h.locks))
+	}
+}
+
+func TestTusUnknownUpload(t *testing.T) {
+	h, err := NewTusHandler(t.TempDir(), "/api/uploads", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"00112233445566778899aabbccddeeff", "not-hex"} {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("uploadID", id)
+
+		req := httptest.NewRequest(http.MethodPatch, "/api/uploads/"+id, strings.NewReader("data"))
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		rec := httptest.NewRecorder()
+		h.Patch(rec, req)
+
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("PATCH %s: got %d, want 404", id, rec.Code)
+		}
+	}
+	if len(h.locks) != 0 {
+		t.Errorf("unknown uploads left %d locks", len(h.locks))
+	}
+}
+
+func TestTusPurgeExpiredSparesActiveUpload(t *testing.T) {
+	h, err := NewTusHandler(t.TempDir(), "/api/uploads", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const id = "00112233445566778899aabbccddeeff"
+	old := time.Now().Add(-2 * time.Hour)
+	for _, path := range []string{h.infoPath(id), h.dataPath(id)} {
+		if err := os.WriteFile(path, []byte("{}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a PATCH holds the lock and is writing when the purge looks
+	unlock := h.lock(id)
+	done := make(chan struct{})
+	go func() {
+		h.PurgeExpired(time.Hour)
+		close(done)
+	}()
+	for {
+		h.mu.Lock()
+		waiting := h.locks[id].refs > 1
+		h.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := os.WriteFile(h.dataPath(id), []byte("more"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	<-done
+
+	if _, err := os.Stat(h.infoPath(id)); err != nil {
+		t.Errorf("upload written to during the purge was removed: %v", err)
+	}
+
+	// without new data it goes on the next run
+	if err := os.Chtimes(h.dataPath(id), old, old); err != nil {
+		t.Fatal(err)
+	}
+	h.PurgeExpired(time.Hour)
+	if _, err := os.Stat(h.infoPath(id)); !os.IsNotExist(err) {
+		t.Errorf("expired upload kept: %v", err)
+	}
+}
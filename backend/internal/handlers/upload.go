@@ -5,54 +5,107 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"time"
 
 	"imageapp/internal/services"
-
-	"github.com/jackc/pgx/v5/pgxpool"
-	pgvector "github.com/pgvector/pgvector-go"
+	"imageapp/internal/storage"
 )
 
 const (
 	maxUploadSize = 50 * 1024 * 1024 // 50 MB for images, this should be enough ...
-	storageDir    = "./storage"
+	maxFieldSize  = 64 * 1024        // title and tags
 )
 
+// JobWaker is told when jobs were queued. services.ImageProcessor is the
+// implementation.
+type JobWaker interface {
+	Wake()
+}
+
 type UploadHandler struct {
-	db             *pgxpool.Pool
-	imageProcessor *services.ImageProcessor
+	db             services.DB
+	store          storage.Storage
+	imageProcessor JobWaker
+	maxPixels      int
 }
 
-func NewUploadHandler(db *pgxpool.Pool, processor *services.ImageProcessor) *UploadHandler {
-	os.MkdirAll(storageDir, 0o755)
+func NewUploadHandler(db services.DB, store storage.Storage, processor JobWaker, maxPixels int) *UploadHandler {
 	return &UploadHandler{
 		db:             db,
+		store:          store,
 		imageProcessor: processor,
+		maxPixels:      maxPixels,
 	}
 }
 
+// Upload reads the multipart body part by part, so the image is streamed
+// to a temp file instead of being held in memory.
 func (h *UploadHandler) Upload(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
+	mr, err := r.MultipartReader()
+	if err != nil {
 		http.Error(w, "invalid multipart form: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	title := r.FormValue("title")
+	var title, tagsRaw, filename, mime string
+	var src *spooledFile
+	defer func() {
+		if src != nil {
+			src.remove()
+		}
+	}()
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			uploadReadError(w, err)
+			return
+		}
+
+		switch part.FormName() {
+		case "title":
+			title, err = readField(part)
+		case "tags":
+			tagsRaw, err = readField(part)
+		case "image":
+			if src != nil {
+				part.Close()
+				http.Error(w, "only one image per upload", http.StatusBadRequest)
+				return
+			}
+			mime = part.Header.Get("Content-Type")
+			if !isAllowedMime(mime) {
+				part.Close()
+				http.Error(w, "unsupported image format", http.StatusBadRequest)
+				return
+			}
+			filename = part.FileName()
+			src, err = spoolToTemp(part)
+		}
+		part.Close()
+		if err != nil {
+			uploadReadError(w, err)
+			return
+		}
+	}
+
 	if title == "" {
 		http.Error(w, "title is required", http.StatusBadRequest)
 		return
 	}
 
 	var tags []string
-	tagsRaw := r.FormValue("tags")
 	if tagsRaw != "" {
 		if err := json.Unmarshal([]byte(tagsRaw), &tags); err != nil {
 			http.Error(w, "invalid tags format", http.StatusBadRequest)
@@ -64,29 +117,15 @@ func (h *UploadHandler) Upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, fh, err := r.FormFile("image")
-	if err != nil {
-		http.Error(w, "missing image field: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-	defer file.Close()
-
-	mime := fh.Header.Get("Content-Type")
-	if !isAllowedMime(mime) {
-		http.Error(w, "unsupported image format", http.StatusBadRequest)
-		return
-	}
-
-	bytes, err := io.ReadAll(file)
-	if err != nil {
-		http.Error(w, "failed to read file", http.StatusInternalServerError)
+	if src == nil {
+		http.Error(w, "missing image field", http.StatusBadRequest)
 		return
 	}
 
 	// use the core function
-	result, err := h.processUpload(ctx, bytes, fh.Filename, mime, title, tags)
+	result, err := h.processUpload(ctx, src, filename, mime, title, tags)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		processUploadError(w, err)
 		return
 	}
 
@@ -96,27 +135,41 @@ func (h *UploadHandler) Upload(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *UploadHandler) SeedImage(ctx context.Context, imagePath, title string, tags []string) error {
-	bytes, err := os.ReadFile(imagePath)
+	f, err := os.Open(imagePath)
 	if err != nil {
 		return fmt.Errorf("read seed image: %w", err)
 	}
+	defer f.Close()
 
-	filename := filepath.Base(imagePath)
-	mime := detectMime(filename)
+	src, err := spoolToTemp(f)
+	if err != nil {
+		return fmt.Errorf("read seed image: %w", err)
+	}
+	defer src.remove()
 
-	_, err = h.processUpload(ctx, bytes, filename, mime, title, tags)
+	// no declared type, the content decides
+	_, err = h.processUpload(ctx, src, filepath.Base(imagePath), "", title, tags)
 	return err
 }
 
-func (h *UploadHandler) processUpload(ctx context.Context, bytes []byte, filename, mime, title string, tags []string) (map[string]any, error) {
-	// Checksum
-	hash := sha256.Sum256(bytes)
-	checksum := hex.EncodeToString(hash[:])
+// processUpload stores an already spooled image, inserts its row and queues
+// it for processing. The temp file is moved into storage, not copied, when
+// the backend allows it. A declared mime type must match the sniffed one.
+func (h *UploadHandler) processUpload(ctx context.Context, src *spooledFile, filename, mime, title string, tags []string) (map[string]any, error) {
+	// Content check
+	sniffed, err := h.sniff(src)
+	if err != nil {
+		return nil, err
+	}
+	if mime != "" && mime != sniffed {
+		return nil, fmt.Errorf("%w: declared %s but content is %s", services.ErrInvalidImage, mime, sniffed)
+	}
+	mime = sniffed
 
 	// Duplicate check
 	var exists bool
-	err := h.db.QueryRow(ctx,
-		"SELECT EXISTS(SELECT 1 FROM images WHERE checksum = $1)", checksum,
+	err = h.db.QueryRow(ctx,
+		"SELECT EXISTS(SELECT 1 FROM images WHERE checksum = $1)", src.checksum,
 	).Scan(&exists)
 	if err != nil {
 		return nil, fmt.Errorf("database error: %w", err)
@@ -125,48 +178,57 @@ func (h *UploadHandler) processUpload(ctx context.Context, bytes []byte, filenam
 		return nil, fmt.Errorf("image already exists")
 	}
 
-	// Save to disk
-	finalName := fmt.Sprintf("%d_%s", time.Now().UnixNano(), filepath.Base(filename))
-	storagePath := filepath.Join(storageDir, finalName)
-	if err := os.WriteFile(storagePath, bytes, 0o644); err != nil {
+	// Save to storage
+	storageKey := fmt.Sprintf("%d_%s", time.Now().UnixNano(), filepath.Base(filename))
+	if err := storage.PutFile(ctx, h.store, storageKey, src.path, mime); err != nil {
 		return nil, fmt.Errorf("save file: %w", err)
 	}
 
-	// Insert into database
-	imageURL := fmt.Sprintf("/uploads/%s", finalName)
+	// Insert into database, together with its processing job
+	imageURL := h.store.URL(storageKey)
 	var id int64
 	var createdAt time.Time
 
-	err = h.db.QueryRow(ctx, `
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		h.store.Delete(ctx, storageKey)
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `
 		INSERT INTO images (title, tags, filename, size, mime, checksum,
-		                    storage_path, image_url, embedding, thumbnail_status)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, 'pending')
+		                    storage_path, image_url, thumbnail_status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 'pending')
 		RETURNING id, created_at
 	`,
 		title,
 		tags,
 		filename,
-		int64(len(bytes)),
+		src.size,
 		mime,
-		checksum,
-		storagePath,
+		src.checksum,
+		storageKey,
 		imageURL,
-		pgvector.NewVector(make([]float32, 384)),
 	).Scan(&id, &createdAt)
 
 	if err != nil {
-		os.Remove(storagePath)
+		h.store.Delete(ctx, storageKey)
 		return nil, fmt.Errorf("db insert: %w", err)
 	}
 
+	if err := services.EnqueueImageJob(ctx, tx, id); err != nil {
+		h.store.Delete(ctx, storageKey)
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		h.store.Delete(ctx, storageKey)
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+
 	// the downloaded image will now be processed ...
-	h.imageProcessor.Queue(services.ImageJob{
-		FileID:   id,
-		FilePath: storagePath,
-		Filename: filename,
-		Title:    title,
-		Tags:     tags,
-	})
+	h.imageProcessor.Wake()
 
 	return map[string]any{
 		"id":        id,
@@ -177,43 +239,101 @@ func (h *UploadHandler) processUpload(ctx context.Context, bytes []byte, filenam
 	}, nil
 }
 
-// previously I had here a pipe based save installed, which seems not necessary now since we are dealing with images ..
-func saveFile(ctx context.Context, src multipart.File, fh *multipart.FileHeader) (string, string, int64, error) {
-	if err := os.MkdirAll(storageDir, 0o755); err != nil {
-		return "", "", 0, err
+// spooledFile is an upload streamed to a temp file and hashed on the way,
+// so memory use stays bounded however large the image is.
+type spooledFile struct {
+	path     string
+	size     int64
+	checksum string
+}
+
+func spoolToTemp(r io.Reader) (*spooledFile, error) {
+	tmp, err := os.CreateTemp("", "imageapp-upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
 	}
 
-	bytes, err := io.ReadAll(src)
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
-		return "", "", 0, err
+		os.Remove(tmp.Name())
+		return nil, err
 	}
 
-	hash := sha256.Sum256(bytes)
-	checksum := hex.EncodeToString(hash[:])
+	return &spooledFile{
+		path:     tmp.Name(),
+		size:     size,
+		checksum: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
 
-	finalName := fmt.Sprintf("%d_%s", time.Now().UnixNano(), filepath.Base(fh.Filename))
-	finalPath := filepath.Join(storageDir, finalName)
+// hashFile wraps a file that is already on disk, e.g. an assembled tus
+// upload, reading it once for the checksum.
+func hashFile(path string) (*spooledFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-	if err := os.WriteFile(finalPath, bytes, 0o644); err != nil {
-		return "", "", 0, err
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return nil, err
 	}
 
-	return finalPath, checksum, int64(len(bytes)), nil
+	return &spooledFile{
+		path:     path,
+		size:     size,
+		checksum: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// remove deletes the temp file if it was not moved into storage.
+func (f *spooledFile) remove() {
+	os.Remove(f.path)
 }
 
-func detectMime(filename string) string {
-	switch filepath.Ext(filename) {
-	case ".jpg", ".jpeg":
-		return "image/jpeg"
-	case ".png":
-		return "image/png"
-	case ".webp":
-		return "image/webp"
-	case ".gif":
-		return "image/gif"
-	default:
-		return "application/octet-stream"
+func readField(r io.Reader) (string, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxFieldSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxFieldSize {
+		return "", fmt.Errorf("form field too large")
+	}
+	return string(b), nil
+}
+
+func uploadReadError(w http.ResponseWriter, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "invalid multipart form: "+err.Error(), http.StatusBadRequest)
+}
+
+func (h *UploadHandler) sniff(src *spooledFile) (string, error) {
+	f, err := os.Open(src.path)
+	if err != nil {
+		return "", fmt.Errorf("open upload: %w", err)
+	}
+	defer f.Close()
+
+	mime, _, err := services.SniffImage(f, h.maxPixels)
+	return mime, err
+}
+
+func processUploadError(w http.ResponseWriter, err error) {
+	if errors.Is(err, services.ErrInvalidImage) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
 	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
 
 func isAllowedMime(mime string) bool {
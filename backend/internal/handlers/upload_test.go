@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"imageapp/internal/services"
+)
+
+func TestProcessUploadChecksDeclaredType(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	h := NewUploadHandler(nil, nil, nil, services.DefaultMaxPixels)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		declared string
+	}{
+		{"png declared as jpeg", buf.Bytes(), "image/jpeg"},
+		{"text declared as png", []byte("not an image at all"), "image/png"},
+		{"text without a declared type", []byte("not an image at all"), ""},
+	}
+	for _, tt := range tests {
+		src, err := spoolToTemp(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = h.processUpload(context.Background(), src, "upload", tt.declared, "title", []string{"tag"})
+		src.remove()
+		if !errors.Is(err, services.ErrInvalidImage) {
+			t.Errorf("%s: got %v, want ErrInvalidImage", tt.name, err)
+			continue
+		}
+		rec := httptest.NewRecorder()
+		processUploadError(rec, err)
+		if rec.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%s: status %d, want 415", tt.name, rec.Code)
+		}
+	}
+}
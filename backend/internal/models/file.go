@@ -19,5 +19,34 @@ type Image struct {
 	Embedding       pgvector.Vector `db:"embedding" json:"-"`
 	ThumbnailPath   *string         `db:"thumbnail_path" json:"-"`
 	ThumbnailStatus string          `db:"thumbnail_status" json:"thumbnail_status"`
+	Metadata        *ImageMetadata  `db:"metadata" json:"metadata,omitempty"`
+	SuggestedTags   []SuggestedTag  `db:"suggested_tags" json:"suggested_tags,omitempty"`
+	RejectedTags    []string        `db:"rejected_tags" json:"rejected_tags,omitempty"`
 	CreatedAt       time.Time       `db:"created_at" json:"created_at"`
 }
+
+// ImageMetadata is read from EXIF during processing and stored as JSONB.
+// Width and Height are those of the upright image.
+type ImageMetadata struct {
+	Width       int        `json:"width"`
+	Height      int        `json:"height"`
+	CameraMake  string     `json:"camera_make,omitempty"`
+	CameraModel string     `json:"camera_model,omitempty"`
+	Lens        string     `json:"lens,omitempty"`
+	TakenAt     *time.Time `json:"taken_at,omitempty"`
+	Orientation int        `json:"orientation,omitempty"`
+	GPS         *GPS       `json:"gps,omitempty"`
+}
+
+type GPS struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// SuggestedTag is a label the auto-tagger found in the image content, with
+// its share of the vocabulary's probability mass.
+type SuggestedTag struct {
+	Tag        string  `json:"tag"`
+	Confidence float32 `json:"confidence"`
+}
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/daulet/tokenizers"
 )
 
@@ -16,16 +19,99 @@ func NewTokenizer(path string) (*Tokenizer, error) {
 	return &Tokenizer{tk: tk}, nil
 }
 
+// Close frees the tokenizer.
+func (t *Tokenizer) Close() error {
+	return t.tk.Close()
+}
+
+// Tokenize returns the token ids of text, special tokens included, cut to
+// at most maxLen. A cut keeps the closing special token, which the models
+// rely on, and reports truncated.
+func (t *Tokenizer) Tokenize(text string, maxLen int) (ids []int64, truncated bool, err error) {
+	raw, _ := t.tk.Encode(text, true)
+	return truncate(raw, maxLen)
+}
+
+func truncate(raw []uint32, maxLen int) (ids []int64, truncated bool, err error) {
+	// with special tokens even "" has some, none means encoding failed
+	if len(raw) == 0 {
+		return nil, false, errors.New("tokenizer returned no tokens")
+	}
+
+	n := min(len(raw), maxLen)
+	ids = make([]int64, n)
+	for i := range ids {
+		ids[i] = int64(raw[i])
+	}
+	if len(raw) > maxLen {
+		ids[n-1] = int64(raw[len(raw)-1])
+		truncated = true
+	}
+	return ids, truncated, nil
+}
+
+// Encode tokenizes text and pads it to exactly maxLen, for models with a
+// fixed context length. The mask marks the real tokens.
 func (t *Tokenizer) Encode(text string, maxLen int) ([]int64, []int64, error) {
-	ids, _ := t.tk.Encode(text, true)
+	ids, _, err := t.Tokenize(text, maxLen)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	inputIDs := make([]int64, maxLen)
 	mask := make([]int64, maxLen)
-
-	for i := 0; i < len(ids) && i < maxLen; i++ {
-		inputIDs[i] = int64(ids[i])
+	copy(inputIDs, ids)
+	for i := range ids {
 		mask[i] = 1
 	}
 
 	return inputIDs, mask, nil
 }
+
+// TokenizePair encodes a and b as one sequence the way BERT-style
+// cross-encoders expect it, [CLS] a [SEP] b [SEP], and returns the token
+// type ids that tell the two apart. If the pair is longer than maxLen, the
+// longer text loses its last token until it fits, b on a tie.
+func (t *Tokenizer) TokenizePair(a, b string, maxLen int) (ids, typeIDs []int64, truncated bool, err error) {
+	rawA, _ := t.tk.Encode(a, true)
+	rawB, _ := t.tk.Encode(b, true)
+	return truncatePair(rawA, rawB, maxLen)
+}
+
+func truncatePair(a, b []uint32, maxLen int) (ids, typeIDs []int64, truncated bool, err error) {
+	if len(a) < 2 || len(b) < 2 {
+		return nil, nil, false, errors.New("tokenizer returned no special tokens")
+	}
+	if maxLen < 3 {
+		return nil, nil, false, fmt.Errorf("max length %d cannot hold a pair", maxLen)
+	}
+
+	// both start with [CLS] and end with [SEP]; b's [CLS] is dropped
+	textA, textB := a[1:len(a)-1], b[1:len(b)-1]
+	for len(textA)+len(textB) > maxLen-3 {
+		if len(textA) > len(textB) {
+			textA = textA[:len(textA)-1]
+		} else {
+			textB = textB[:len(textB)-1]
+		}
+		truncated = true
+	}
+
+	ids = make([]int64, 0, len(textA)+len(textB)+3)
+	ids = append(ids, int64(a[0]))
+	for _, id := range textA {
+		ids = append(ids, int64(id))
+	}
+	ids = append(ids, int64(a[len(a)-1]))
+	first := len(ids)
+	for _, id := range textB {
+		ids = append(ids, int64(id))
+	}
+	ids = append(ids, int64(b[len(b)-1]))
+
+	typeIDs = make([]int64, len(ids))
+	for i := first; i < len(ids); i++ {
+		typeIDs[i] = 1
+	}
+	return ids, typeIDs, truncated, nil
+}
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"slices"
+	"testing"
+)
+
+// cls and sep stand in for the special tokens the tokenizer adds.
+const (
+	cls = 101
+	sep = 102
+)
+
+func withSpecial(ids ...uint32) []uint32 {
+	return append(append([]uint32{cls}, ids...), sep)
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		raw       []uint32
+		maxLen    int
+		want      []int64
+		truncated bool
+	}{
+		{"fits", withSpecial(1, 2, 3), 5, []int64{cls, 1, 2, 3, sep}, false},
+		{"room to spare", withSpecial(1), 8, []int64{cls, 1, sep}, false},
+		{"cut keeps the closing token", withSpecial(1, 2, 3), 4, []int64{cls, 1, 2, sep}, true},
+		{"only special tokens left", withSpecial(1, 2, 3), 2, []int64{cls, sep}, true},
+	} {
+		ids, truncated, err := truncate(tc.raw, tc.maxLen)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !slices.Equal(ids, tc.want) || truncated != tc.truncated {
+			t.Errorf("%s: got %v, truncated %t, want %v, %t", tc.name, ids, truncated, tc.want, tc.truncated)
+		}
+	}
+
+	if _, _, err := truncate(nil, 8); err == nil {
+		t.Error("no tokens accepted")
+	}
+}
+
+func TestTruncatePair(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		a, b      []uint32
+		maxLen    int
+		want      []int64
+		types     []int64
+		truncated bool
+	}{
+		{
+			"fits",
+			withSpecial(1, 2), withSpecial(3), 8,
+			[]int64{cls, 1, 2, sep, 3, sep},
+			[]int64{0, 0, 0, 0, 1, 1},
+			false,
+		},
+		{
+			"long document is cut",
+			withSpecial(1), withSpecial(3, 4, 5, 6, 7), 7,
+			[]int64{cls, 1, sep, 3, 4, 5, sep},
+			[]int64{0, 0, 0, 1, 1, 1, 1},
+			true,
+		},
+		{
+			"long query is cut",
+			withSpecial(1, 2, 3, 4, 5), withSpecial(6), 7,
+			[]int64{cls, 1, 2, 3, sep, 6, sep},
+			[]int64{0, 0, 0, 0, 0, 1, 1},
+			true,
+		},
+		{
+			"both cut, document first on a tie",
+			withSpecial(1, 2, 3, 4), withSpecial(5, 6, 7, 8), 8,
+			[]int64{cls, 1, 2, 3, sep, 5, 6, sep},
+			[]int64{0, 0, 0, 0, 0, 1, 1, 1},
+			true,
+		},
+	} {
+		ids, types, truncated, err := truncatePair(tc.a, tc.b, tc.maxLen)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !slices.Equal(ids, tc.want) || !slices.Equal(types, tc.types) || truncated != tc.truncated {
+			t.Errorf("%s: got %v %v, truncated %t, want %v %v, %t",
+				tc.name, ids, types, truncated, tc.want, tc.types, tc.truncated)
+		}
+		if len(ids) > tc.maxLen {
+			t.Errorf("%s: %d tokens, max %d", tc.name, len(ids), tc.maxLen)
+		}
+	}
+
+	if _, _, _, err := truncatePair(nil, withSpecial(1), 8); err == nil {
+		t.Error("no tokens accepted")
+	}
+	if _, _, _, err := truncatePair(withSpecial(1), withSpecial(2), 2); err == nil {
+		t.Error("max length too short for a pair accepted")
+	}
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+
+	"imageapp/internal/models"
+)
+
+// clipLogitScale is the temperature CLIP was trained with; it turns cosine
+// similarities into logits for the softmax over the vocabulary.
+const clipLogitScale = 100
+
+// Tagger suggests tags for an image embedding. AutoTagger is the
+// implementation.
+type Tagger interface {
+	Suggest(imageEmbedding []float32, tags, rejected []string) []models.SuggestedTag
+}
+
+// SameTag reports whether two tags are the same label. Suggestions, tags
+// and rejections are all compared with it.
+func SameTag(a, b string) bool {
+	return strings.EqualFold(a, b)
+}
+
+// ContainsTag reports whether tags has a tag that is the same label as tag.
+func ContainsTag(tags []string, tag string) bool {
+	return slices.ContainsFunc(tags, func(t string) bool { return SameTag(t, tag) })
+}
+
+// AutoTagger suggests tags by zero-shot classification: the image's CLIP
+// embedding is compared to the embedded labels of a vocabulary, and the
+// softmax over all labels gives each a confidence.
+type AutoTagger struct {
+	labels        []string
+	vectors       [][]float32
+	topK          int
+	minConfidence float32
+}
+
+// NewAutoTagger embeds every label of the vocabulary file, one label per
+// line, blank lines and lines starting with # are skipped.
+func NewAutoTagger(clip VisualEncoder, vocabularyPath string, topK int, minConfidence float64) (*AutoTagger, error) {
+	labels, err := readVocabulary(vocabularyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &AutoTagger{
+		labels:        labels,
+		topK:          topK,
+		minConfidence: float32(minConfidence),
+	}
+	for _, label := range labels {
+		// the prompt template from the CLIP paper
+		vec, err := clip.EmbedText("a photo of " + label)
+		if err != nil {
+			return nil, fmt.Errorf("embed label %q: %w", label, err)
+		}
+		t.vectors = append(t.vectors, vec)
+	}
+	return t, nil
+}
+
+func readVocabulary(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open vocabulary: %w", err)
+	}
+	defer f.Close()
+
+	var labels []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		label := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if label == "" || strings.HasPrefix(label, "#") || seen[label] {
+			continue
+		}
+		seen[label] = true
+		labels = append(labels, label)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read vocabulary: %w", err)
+	}
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("vocabulary %s has no labels", path)
+	}
+	return labels, nil
+}
+
+// Suggest returns up to topK labels for a normalized image embedding, most
+// confident first, leaving out labels below the threshold, those already
+// in tags and those a user rejected before.
+func (t *AutoTagger) Suggest(imageEmbedding []float32, tags, rejected []string) []models.SuggestedTag {
+	logits := make([]float64, len(t.labels))
+	maxLogit := math.Inf(-1)
+	for i, vec := range t.vectors {
+		var dot float32
+		for j := range vec {
+			dot += vec[j] * imageEmbedding[j]
+		}
+		logits[i] = clipLogitScale * float64(dot)
+		maxLogit = max(maxLogit, logits[i])
+	}
+	var sum float64
+	for i := range logits {
+		logits[i] = math.Exp(logits[i] - maxLogit)
+		sum += logits[i]
+	}
+
+	suggestions := []models.SuggestedTag{}
+	for i, label := range t.labels {
+		confidence := float32(logits[i] / sum)
+		if confidence < t.minConfidence || ContainsTag(tags, label) || ContainsTag(rejected, label) {
+			continue
+		}
+		suggestions = append(suggestions, models.SuggestedTag{Tag: label, Confidence: confidence})
+	}
+	slices.SortFunc(suggestions, func(a, b models.SuggestedTag) int {
+		switch {
+		case a.Confidence > b.Confidence:
+			return -1
+		case a.Confidence < b.Confidence:
+			return 1
+		}
+		return strings.Compare(a.Tag, b.Tag)
+	})
+	if len(suggestions) > t.topK {
+		suggestions = suggestions[:t.topK]
+	}
+	return suggestions
+}
@@ -0,0 +1,60 @@
+package services
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// labelEncoder embeds every prompt onto its own axis, in vocabulary order.
+type labelEncoder struct {
+	axes map[string]int
+}
+
+func (e labelEncoder) EmbedImage(image.Image) ([]float32, error) {
+	return nil, nil
+}
+
+func (e labelEncoder) EmbedText(text string) ([]float32, error) {
+	v := make([]float32, len(e.axes))
+	v[e.axes[strings.TrimPrefix(text, "a photo of ")]] = 1
+	return v, nil
+}
+
+func TestAutoTaggerSuggest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vocabulary.txt")
+	if err := os.WriteFile(path, []byte("# labels\nsky\nsea\nsand\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tagger, err := NewAutoTagger(labelEncoder{axes: map[string]int{"sky": 0, "sea": 1, "sand": 2}}, path, 5, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mostly sky, some sea, a little sand
+	vec := []float32{0.08, 0.06, 0.04}
+
+	tests := []struct {
+		name           string
+		tags, rejected []string
+		want           string
+	}{
+		{"all labels", nil, nil, "sky,sea,sand"},
+		{"tagged", []string{"Sky"}, nil, "sea,sand"},
+		{"rejected", nil, []string{"SEA"}, "sky,sand"},
+		{"tagged and rejected", []string{"sand"}, []string{"sky"}, "sea"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, s := range tagger.Suggest(vec, tt.tags, tt.rejected) {
+				got = append(got, s.Tag)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("suggested %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
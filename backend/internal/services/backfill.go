@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	"imageapp/internal/storage"
+
+	"github.com/jackc/pgx/v5"
+	pgvector "github.com/pgvector/pgvector-go"
+)
+
+// Backfill recomputes the text vectors of every processed image with the
+// current composition, batchSize images at a time. It is meant for after
+// EMBED_TEXT or EMBED_TITLE_WEIGHT changed; images edited while it runs
+// are skipped, the edit has already embedded them.
+func Backfill(ctx context.Context, db DB, models *ModelSet, batchSize int) (int, error) {
+	var lastID int64
+	var done int
+	for {
+		rows, err := db.Query(ctx, `
+			SELECT id, title, tags FROM images
+			WHERE embedding_model IS NOT NULL AND id > $1
+			ORDER BY id
+			LIMIT $2
+		`, lastID, batchSize)
+		if err != nil {
+			return done, fmt.Errorf("query: %w", err)
+		}
+
+		var ids []int64
+		var titles []string
+		var tags [][]string
+		for rows.Next() {
+			var id int64
+			var title string
+			var t []string
+			if err := rows.Scan(&id, &title, &t); err != nil {
+				rows.Close()
+				return done, fmt.Errorf("scan: %w", err)
+			}
+			ids = append(ids, id)
+			titles = append(titles, title)
+			tags = append(tags, t)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return done, fmt.Errorf("query: %w", err)
+		}
+		if len(ids) == 0 {
+			return done, nil
+		}
+
+		vectors, err := models.EmbedImageTexts(ctx, titles, tags)
+		if err != nil {
+			return done, fmt.Errorf("embed: %w", err)
+		}
+
+		for i, id := range ids {
+			written, err := backfillImage(ctx, db, id, titles[i], tags[i], vectors[i])
+			if err != nil {
+				return done, fmt.Errorf("image %d: %w", id, err)
+			}
+			if written {
+				done++
+			}
+		}
+		lastID = ids[len(ids)-1]
+		log.Printf("Backfill: %d images re-embedded, up to id %d", done, lastID)
+	}
+}
+
+// backfillImage writes the vectors of one image unless its title or tags
+// changed since they were read.
+func backfillImage(ctx context.Context, db DB, id int64, title string, tags []string, vectors map[string][]float32) (bool, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// active model first, the same lock order as every other writer
+	if err := WriteTextEmbeddings(ctx, tx, id, title, tags, vectors); err != nil {
+		return false, err
+	}
+
+	var curTitle string
+	var curTags []string
+	err = tx.QueryRow(ctx, `
+		SELECT title, tags FROM images WHERE id = $1
+	`, id).Scan(&curTitle, &curTags)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("reload: %w", err)
+	}
+	if curTitle != title || !slices.Equal(curTags, tags) {
+		return false, nil
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("commit: %w", err)
+	}
+	return true, nil
+}
+
+// BackfillVisual computes the missing content embeddings of processed
+// images, e.g. of those uploaded before CLIP was set up. Images that do not
+// decode are logged and skipped.
+func BackfillVisual(ctx context.Context, db DB, store storage.Storage, clip VisualEncoder, maxPixels, batchSize int) (int, error) {
+	var lastID int64
+	var done int
+	for {
+		rows, err := db.Query(ctx, `
+			SELECT id, storage_path FROM images
+			WHERE image_embedding IS NULL AND thumbnail_status = 'ready' AND id > $1
+			ORDER BY id
+			LIMIT $2
+		`, lastID, batchSize)
+		if err != nil {
+			return done, fmt.Errorf("query: %w", err)
+		}
+		var ids []int64
+		var keys []string
+		for rows.Next() {
+			var id int64
+			var key string
+			if err := rows.Scan(&id, &key); err != nil {
+				rows.Close()
+				return done, fmt.Errorf("scan: %w", err)
+			}
+			ids = append(ids, id)
+			keys = append(keys, key)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return done, fmt.Errorf("query: %w", err)
+		}
+		if len(ids) == 0 {
+			return done, nil
+		}
+
+		for i, id := range ids {
+			vec, err := embedStoredImage(ctx, store, clip, keys[i], maxPixels)
+			if errors.Is(err, ErrInvalidImage) {
+				log.Printf("Backfill: skipping image %d: %v", id, err)
+				continue
+			}
+			if err != nil {
+				return done, fmt.Errorf("image %d: %w", id, err)
+			}
+			// an image processed meanwhile already has its vector
+			tag, err := db.Exec(ctx, `
+				UPDATE images SET image_embedding = $1
+				WHERE id = $2 AND image_embedding IS NULL
+			`, pgvector.NewVector(vec), id)
+			if err != nil {
+				return done, fmt.Errorf("image %d: %w", id, err)
+			}
+			done += int(tag.RowsAffected())
+		}
+		lastID = ids[len(ids)-1]
+		log.Printf("Backfill: %d images visually embedded, up to id %d", done, lastID)
+	}
+}
+
+func embedStoredImage(ctx context.Context, store storage.Storage, clip VisualEncoder, key string, maxPixels int) ([]float32, error) {
+	obj, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("open image: %w", err)
+	}
+	defer obj.Close()
+
+	img, err := DecodeImage(obj, maxPixels)
+	if err != nil {
+		return nil, err
+	}
+	return clip.EmbedImage(img)
+}
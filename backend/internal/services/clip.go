@@ -0,0 +1,217 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"sync"
+
+	"imageapp/internal/models"
+
+	"github.com/disintegration/imaging"
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+const (
+	ClipDim        = 512
+	clipImageSize  = 224
+	clipContextLen = 77
+)
+
+// CLIP normalization constants per RGB channel.
+var (
+	clipMean = [3]float32{0.48145466, 0.4578275, 0.40821073}
+	clipStd  = [3]float32{0.26862954, 0.26130258, 0.27577711}
+)
+
+// VisualEncoder embeds images and text into one space. ClipService is the
+// implementation.
+type VisualEncoder interface {
+	EmbedImage(img image.Image) ([]float32, error)
+	EmbedText(text string) ([]float32, error)
+}
+
+// ClipService maps images and text into the same vector space, so a text
+// query can be matched against what is actually in the picture. It runs
+// the two halves of a CLIP model exported as separate ONNX files.
+type ClipService struct {
+	imageMu      sync.Mutex
+	imageSession *ort.AdvancedSession
+	pixelValues  *ort.Tensor[float32]
+	imageEmbeds  *ort.Tensor[float32]
+
+	textMu        sync.Mutex
+	textSession   *ort.AdvancedSession
+	tokenizer     *models.Tokenizer
+	inputIDs      *ort.Tensor[int64]
+	attentionMask *ort.Tensor[int64]
+	textEmbeds    *ort.Tensor[float32]
+
+	once sync.Once
+}
+
+func NewClipService(visionModelPath, textModelPath, tokenizerPath string) (*ClipService, error) {
+	if err := acquireONNX(); err != nil {
+		return nil, err
+	}
+
+	// on any error, free what was created so far and give the runtime back
+	c := &ClipService{}
+	ok := false
+	defer func() {
+		if !ok {
+			c.destroy()
+		}
+	}()
+
+	var err error
+	c.pixelValues, err = ort.NewTensor(ort.NewShape(1, 3, clipImageSize, clipImageSize),
+		make([]float32, 3*clipImageSize*clipImageSize))
+	if err != nil {
+		return nil, fmt.Errorf("create pixel tensor: %w", err)
+	}
+
+	c.imageEmbeds, err = ort.NewTensor(ort.NewShape(1, ClipDim), make([]float32, ClipDim))
+	if err != nil {
+		return nil, fmt.Errorf("create image output tensor: %w", err)
+	}
+
+	c.imageSession, err = ort.NewAdvancedSession(
+		visionModelPath,
+		[]string{"pixel_values"},
+		[]string{"image_embeds"},
+		[]ort.ArbitraryTensor{c.pixelValues},
+		[]ort.ArbitraryTensor{c.imageEmbeds},
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create vision session: %w", err)
+	}
+
+	c.inputIDs, err = ort.NewTensor(ort.NewShape(1, clipContextLen), make([]int64, clipContextLen))
+	if err != nil {
+		return nil, fmt.Errorf("create input tensor: %w", err)
+	}
+
+	c.attentionMask, err = ort.NewTensor(ort.NewShape(1, clipContextLen), make([]int64, clipContextLen))
+	if err != nil {
+		return nil, fmt.Errorf("create attention tensor: %w", err)
+	}
+
+	c.textEmbeds, err = ort.NewTensor(ort.NewShape(1, ClipDim), make([]float32, ClipDim))
+	if err != nil {
+		return nil, fmt.Errorf("create text output tensor: %w", err)
+	}
+
+	c.textSession, err = ort.NewAdvancedSession(
+		textModelPath,
+		[]string{"input_ids", "attention_mask"},
+		[]string{"text_embeds"},
+		[]ort.ArbitraryTensor{c.inputIDs, c.attentionMask},
+		[]ort.ArbitraryTensor{c.textEmbeds},
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create text session: %w", err)
+	}
+
+	c.tokenizer, err = models.NewTokenizer(tokenizerPath)
+	if err != nil {
+		return nil, fmt.Errorf("load tokenizer: %w", err)
+	}
+
+	ok = true
+	return c, nil
+}
+
+// EmbedImage returns the normalized content embedding of img.
+func (c *ClipService) EmbedImage(img image.Image) ([]float32, error) {
+	pixels := clipPreprocess(img)
+
+	c.imageMu.Lock()
+	defer c.imageMu.Unlock()
+
+	copy(c.pixelValues.GetData(), pixels)
+	if err := c.imageSession.Run(); err != nil {
+		return nil, fmt.Errorf("inference: %w", err)
+	}
+
+	embedding := append([]float32(nil), c.imageEmbeds.GetData()...)
+	Normalize(embedding)
+	return embedding, nil
+}
+
+// EmbedText returns the normalized embedding of a text query in the same
+// space as EmbedImage.
+func (c *ClipService) EmbedText(text string) ([]float32, error) {
+	inputIDs, attentionMask, err := c.tokenizer.Encode(text, clipContextLen)
+	if err != nil {
+		return nil, fmt.Errorf("tokenize: %w", err)
+	}
+
+	c.textMu.Lock()
+	defer c.textMu.Unlock()
+
+	copy(c.inputIDs.GetData(), inputIDs)
+	copy(c.attentionMask.GetData(), attentionMask)
+	if err := c.textSession.Run(); err != nil {
+		return nil, fmt.Errorf("inference: %w", err)
+	}
+
+	embedding := append([]float32(nil), c.textEmbeds.GetData()...)
+	Normalize(embedding)
+	return embedding, nil
+}
+
+// clipPreprocess scales the shorter side to 224, center-crops a square and
+// returns normalized CHW floats, like the CLIP image processor does.
+func clipPreprocess(img image.Image) []float32 {
+	b := img.Bounds()
+	if b.Dx() < b.Dy() {
+		img = imaging.Resize(img, clipImageSize, 0, imaging.CatmullRom)
+	} else {
+		img = imaging.Resize(img, 0, clipImageSize, imaging.CatmullRom)
+	}
+	square := imaging.CropCenter(img, clipImageSize, clipImageSize)
+
+	const plane = clipImageSize * clipImageSize
+	pixels := make([]float32, 3*plane)
+	for y := 0; y < clipImageSize; y++ {
+		for x := 0; x < clipImageSize; x++ {
+			i := square.PixOffset(x, y)
+			for ch := 0; ch < 3; ch++ {
+				v := float32(square.Pix[i+ch]) / 255
+				pixels[ch*plane+y*clipImageSize+x] = (v - clipMean[ch]) / clipStd[ch]
+			}
+		}
+	}
+	return pixels
+}
+
+func (c *ClipService) Close() {
+	c.once.Do(c.destroy)
+}
+
+// destroy frees the sessions, tensors and tokenizer that exist, sessions
+// first since they use the tensors, and releases the runtime.
+func (c *ClipService) destroy() {
+	if c.imageSession != nil {
+		c.imageSession.Destroy()
+	}
+	if c.textSession != nil {
+		c.textSession.Destroy()
+	}
+	for _, t := range []*ort.Tensor[float32]{c.pixelValues, c.imageEmbeds, c.textEmbeds} {
+		if t != nil {
+			t.Destroy()
+		}
+	}
+	for _, t := range []*ort.Tensor[int64]{c.inputIDs, c.attentionMask} {
+		if t != nil {
+			t.Destroy()
+		}
+	}
+	if c.tokenizer != nil {
+		c.tokenizer.Close()
+	}
+	releaseONNX()
+}
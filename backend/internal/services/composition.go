@@ -0,0 +1,96 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TextComposer decides which text of an image goes into its tag vector:
+//
+//	tags      the tags joined by spaces (the original behaviour)
+//	title     the title only
+//	concat    title followed by the tags, embedded as one text
+//	weighted  title and tags embedded separately and averaged, the title
+//	          counting TitleWeight, the tags 1-TitleWeight
+type TextComposer struct {
+	Mode        string
+	TitleWeight float32
+}
+
+func NewTextComposer(mode string, titleWeight float64) (*TextComposer, error) {
+	switch mode {
+	case "tags", "title", "concat":
+	case "weighted":
+		if titleWeight < 0 || titleWeight > 1 {
+			return nil, fmt.Errorf("title weight must be between 0 and 1, got %g", titleWeight)
+		}
+	default:
+		return nil, fmt.Errorf("unknown text composition %q (tags, title, concat or weighted)", mode)
+	}
+	return &TextComposer{Mode: mode, TitleWeight: float32(titleWeight)}, nil
+}
+
+// UsesTitle reports whether a title change alters the vector.
+func (c *TextComposer) UsesTitle() bool {
+	return c.Mode != "tags"
+}
+
+// texts returns what has to be embedded for one image: one text, or title
+// and tags for weighted.
+func (c *TextComposer) texts(title string, tags []string) []string {
+	joined := strings.Join(tags, " ")
+	switch c.Mode {
+	case "title":
+		return []string{title}
+	case "concat":
+		return []string{title + ". " + joined}
+	case "weighted":
+		return []string{title, joined}
+	default:
+		return []string{joined}
+	}
+}
+
+// combine turns the embeddings of texts into the image's vector.
+func (c *TextComposer) combine(vectors [][]float32) []float32 {
+	if c.Mode != "weighted" {
+		return vectors[0]
+	}
+	title, tags := vectors[0], vectors[1]
+	combined := make([]float32, len(title))
+	for i := range combined {
+		combined[i] = c.TitleWeight*title[i] + (1-c.TitleWeight)*tags[i]
+	}
+	Normalize(combined)
+	return combined
+}
+
+// Embed computes the vector of one image with e.
+func (c *TextComposer) Embed(e Embedder, title string, tags []string) ([]float32, error) {
+	vectors, err := c.EmbedBatch(e, []string{title}, [][]string{tags})
+	if err != nil {
+		return nil, err
+	}
+	return vectors[0], nil
+}
+
+// EmbedBatch computes the vectors of several images with a single
+// EmbedBatch call on e.
+func (c *TextComposer) EmbedBatch(e Embedder, titles []string, tags [][]string) ([][]float32, error) {
+	var texts []string
+	for i := range titles {
+		texts = append(texts, c.texts(titles[i], tags[i])...)
+	}
+
+	embeddings, err := e.EmbedBatch(texts)
+	if err != nil {
+		return nil, err
+	}
+
+	per := len(texts) / len(titles)
+	vectors := make([][]float32, len(titles))
+	for i := range vectors {
+		vectors[i] = c.combine(embeddings[i*per : (i+1)*per])
+	}
+	return vectors, nil
+}
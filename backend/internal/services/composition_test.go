@@ -0,0 +1,169 @@
+package services_test
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"imageapp/internal/services"
+	"imageapp/internal/testdb"
+
+	pgvector "github.com/pgvector/pgvector-go"
+)
+
+func TestTextComposerModes(t *testing.T) {
+	e := services.NewFakeEmbedder(64)
+	title, tags := "Sunset", []string{"beach", "sea"}
+	embed := func(text string) []float32 {
+		v, _ := e.EmbedTags(text)
+		return v
+	}
+
+	for _, tc := range []struct {
+		mode string
+		want []float32
+	}{
+		{"tags", embed("beach sea")},
+		{"title", embed("Sunset")},
+		{"concat", embed("Sunset. beach sea")},
+	} {
+		c, err := services.NewTextComposer(tc.mode, 0.5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Embed(e, title, tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slicesAlmostEqual(got, tc.want) {
+			t.Errorf("%s: vector does not match the embedded text", tc.mode)
+		}
+		if c.UsesTitle() != (tc.mode != "tags") {
+			t.Errorf("%s: UsesTitle = %t", tc.mode, c.UsesTitle())
+		}
+	}
+}
+
+func TestTextComposerWeighted(t *testing.T) {
+	e := services.NewFakeEmbedder(64)
+	titleVec, _ := e.EmbedTags("Sunset")
+	tagsVec, _ := e.EmbedTags("beach sea")
+
+	for _, weight := range []float64{0, 0.3, 0.5, 1} {
+		c, err := services.NewTextComposer("weighted", weight)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Embed(e, "Sunset", []string{"beach", "sea"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := make([]float32, len(got))
+		for i := range want {
+			want[i] = float32(weight)*titleVec[i] + float32(1-weight)*tagsVec[i]
+		}
+		services.Normalize(want)
+		if !slicesAlmostEqual(got, want) {
+			t.Errorf("weight %g: not the normalized weighted average", weight)
+		}
+		var norm float64
+		for _, x := range got {
+			norm += float64(x) * float64(x)
+		}
+		if math.Abs(norm-1) > 1e-5 {
+			t.Errorf("weight %g: squared norm %g, want 1", weight, norm)
+		}
+	}
+
+	for _, weight := range []float64{-0.1, 1.1} {
+		if _, err := services.NewTextComposer("weighted", weight); err == nil {
+			t.Errorf("weight %g accepted", weight)
+		}
+	}
+	if _, err := services.NewTextComposer("summary", 0.5); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+func TestTextComposerEmbedBatch(t *testing.T) {
+	e := &countingEmbedder{FakeEmbedder: services.NewFakeEmbedder(64)}
+	c, err := services.NewTextComposer("weighted", 0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := []string{"Sunset", "Forest", "City"}
+	tags := [][]string{{"beach"}, {"trees", "moss"}, nil}
+
+	vectors, err := c.EmbedBatch(e, titles, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.batches) != 1 || e.batches[0] != 2*len(titles) {
+		t.Errorf("embedded in batches %v, want one of %d texts", e.batches, 2*len(titles))
+	}
+	for i := range titles {
+		want, err := c.Embed(e.FakeEmbedder, titles[i], tags[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slicesAlmostEqual(vectors[i], want) {
+			t.Errorf("image %d: batched vector differs from a single one", i)
+		}
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.New(t)
+	e := services.NewFakeEmbedder(services.EmbeddingDim)
+	// embedded from tags so far
+	testdb.Models(t, db, e)
+
+	images := map[string][]string{"Sunset": {"beach"}, "Forest": {"trees"}, "City": {"night"}}
+	ids := map[string]int64{}
+	for title, tags := range images {
+		vec, _ := e.EmbedTags(tags...)
+		var id int64
+		err := db.QueryRow(ctx, `
+			INSERT INTO images (title, tags, filename, size, mime, checksum, storage_path, image_url, thumbnail_status, embedding, embedding_model)
+			VALUES ($1, $2, 'x.png', 1, 'image/png', $1, 'originals/x.png', '/uploads/x.png', 'ready', $3, 'fake')
+			RETURNING id
+		`, title, tags, pgvector.NewVector(vec)).Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[title] = id
+	}
+
+	// the same model, now composing title and tags
+	composer, err := services.NewTextComposer("concat", 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	models, err := services.NewModelSet(ctx, db, services.EmbeddingModel{Name: "fake", Embedder: e}, nil, composer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := services.Backfill(ctx, db, models, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(images) {
+		t.Errorf("backfilled %d images, want %d", n, len(images))
+	}
+
+	for title, tags := range images {
+		want, err := composer.Embed(e, title, tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got pgvector.Vector
+		if err := db.QueryRow(ctx, "SELECT embedding FROM images WHERE id = $1", ids[title]).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !slicesAlmostEqual(got.Slice(), want) {
+			t.Errorf("%s: vector not recomputed from title and tags", title)
+		}
+	}
+}
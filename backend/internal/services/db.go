@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// DB is the part of *pgxpool.Pool the handlers and the processor use.
+type DB interface {
+	Execer
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// Migrate creates or updates the schema. Every statement is idempotent,
+// so it runs on each start. Data fixes that must only run once are
+// recorded in schema_migrations.
+func Migrate(ctx context.Context, db Execer) error {
+	_, err := db.Exec(ctx, `
+		CREATE EXTENSION IF NOT EXISTS vector;
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			name        TEXT PRIMARY KEY,
+			applied_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE TABLE IF NOT EXISTS images (
+			id                BIGSERIAL PRIMARY KEY,
+			title             TEXT NOT NULL,
+			tags              TEXT[] NOT NULL,
+			filename          TEXT NOT NULL,
+			size              BIGINT NOT NULL,
+			mime              TEXT NOT NULL,
+			checksum          TEXT NOT NULL UNIQUE,
+			storage_path      TEXT NOT NULL,
+			image_url         TEXT NOT NULL,
+			embedding         vector(384),
+			thumbnail_path    TEXT,
+			thumbnail_status  TEXT NOT NULL DEFAULT 'pending',
+			created_at        TIMESTAMPTZ DEFAULT NOW()
+		);
+
+		ALTER TABLE images ADD COLUMN IF NOT EXISTS metadata JSONB;
+		ALTER TABLE images ADD COLUMN IF NOT EXISTS image_embedding vector(512);
+		ALTER TABLE images ALTER COLUMN embedding DROP NOT NULL;
+		ALTER TABLE images ADD COLUMN IF NOT EXISTS embedding_model TEXT;
+		ALTER TABLE images ADD COLUMN IF NOT EXISTS suggested_tags JSONB;
+		-- suggestions a user turned down, never suggested again
+		ALTER TABLE images ADD COLUMN IF NOT EXISTS rejected_tags TEXT[] NOT NULL DEFAULT '{}';
+
+		-- text embedding models; images.embedding holds the active one's
+		-- vectors, image_embeddings those of the others
+		CREATE TABLE IF NOT EXISTS embedding_models (
+			name          TEXT PRIMARY KEY,
+			dim           INT NOT NULL,
+			status        TEXT NOT NULL DEFAULT 'building',
+			created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			activated_at  TIMESTAMPTZ
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS embedding_models_active_idx
+			ON embedding_models (status) WHERE status = 'active';
+
+		CREATE TABLE IF NOT EXISTS image_embeddings (
+			image_id   BIGINT NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+			model      TEXT NOT NULL REFERENCES embedding_models(name),
+			embedding  vector NOT NULL,
+			tags       TEXT[] NOT NULL, -- what embedding was computed from
+			PRIMARY KEY (image_id, model)
+		);
+		ALTER TABLE image_embeddings ADD COLUMN IF NOT EXISTS title TEXT NOT NULL DEFAULT '';
+
+		CREATE INDEX IF NOT EXISTS images_image_embedding_idx
+			ON images USING hnsw (image_embedding vector_cosine_ops);
+
+		CREATE INDEX IF NOT EXISTS images_embedding_idx 
+			ON images USING hnsw (embedding vector_cosine_ops);
+
+		-- full-text document for lexical search; array_to_string is only
+		-- STABLE, the wrapper lets the generated column use it
+		CREATE OR REPLACE FUNCTION image_search_document(title TEXT, tags TEXT[])
+		RETURNS tsvector LANGUAGE sql IMMUTABLE AS $$
+			SELECT setweight(to_tsvector('english', title), 'A') ||
+			       setweight(to_tsvector('english', array_to_string(tags, ' ')), 'B')
+		$$;
+		ALTER TABLE images ADD COLUMN IF NOT EXISTS search_vector tsvector
+			GENERATED ALWAYS AS (image_search_document(title, tags)) STORED;
+
+		CREATE INDEX IF NOT EXISTS images_search_vector_idx
+			ON images USING gin (search_vector);
+
+		CREATE TABLE IF NOT EXISTS image_jobs (
+			id           BIGSERIAL PRIMARY KEY,
+			image_id     BIGINT NOT NULL UNIQUE REFERENCES images(id) ON DELETE CASCADE,
+			status       TEXT NOT NULL DEFAULT 'queued',
+			run_at       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			locked_by    TEXT,
+			lease_until  TIMESTAMPTZ,
+			attempts     INT NOT NULL DEFAULT 0,
+			last_error   TEXT,
+			created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+
+		ALTER TABLE image_jobs ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+		ALTER TABLE image_jobs ADD COLUMN IF NOT EXISTS last_error TEXT;
+		-- 'failed' was the terminal state before retries, now it is 'dead'
+		DO $$ BEGIN
+			IF NOT EXISTS (SELECT 1 FROM schema_migrations WHERE name = 'image_jobs_failed_to_dead') THEN
+				UPDATE image_jobs SET status = 'dead' WHERE status = 'failed';
+				INSERT INTO schema_migrations (name) VALUES ('image_jobs_failed_to_dead')
+				ON CONFLICT (name) DO NOTHING;
+			END IF;
+		END $$;
+
+		CREATE INDEX IF NOT EXISTS image_jobs_runnable_idx
+			ON image_jobs (status, run_at);
+
+		CREATE TABLE IF NOT EXISTS image_renditions (
+			image_id     BIGINT NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+			name         TEXT NOT NULL,
+			storage_key  TEXT NOT NULL,
+			width        INT NOT NULL,
+			height       INT NOT NULL,
+			PRIMARY KEY (image_id, name)
+		);
+
+		-- storage_path and thumbnail_path hold storage keys, not file paths
+		UPDATE images
+		SET storage_path = regexp_replace(storage_path, '^(\./)?storage/', '')
+		WHERE storage_path ~ '^(\./)?storage/';
+		UPDATE images
+		SET thumbnail_path = regexp_replace(thumbnail_path, '^(\./)?storage/', '')
+		WHERE thumbnail_path ~ '^(\./)?storage/';
+
+		-- images left over from the old in-memory queue
+		INSERT INTO image_jobs (image_id)
+		SELECT id FROM images
+		WHERE thumbnail_status IN ('pending', 'processing')
+		ON CONFLICT (image_id) DO NOTHING;
+	`)
+	return err
+}
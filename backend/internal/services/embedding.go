@@ -3,105 +3,208 @@ package services
 import (
 	"fmt"
 	"imageapp/internal/models"
+	"log"
 	"math"
+	"runtime"
 	"strings"
 	"sync"
 
 	ort "github.com/yalue/onnxruntime_go"
 )
 
-type EmbeddingService struct {
-	mu            sync.Mutex
-	session       *ort.AdvancedSession
-	tokenizer     *models.Tokenizer
-	inputIDs      *ort.Tensor[int64]
-	attentionMask *ort.Tensor[int64]
-	tokenTypeIDs  *ort.Tensor[int64]
-	output        *ort.Tensor[float32]
-	once          sync.Once
+// Embedder turns tags and queries into normalized vectors for the
+// embedding column. EmbeddingService is the real implementation,
+// FakeEmbedder a model-free stand-in.
+type Embedder interface {
+	EmbedTags(tags ...string) ([]float32, error)
+	EmbedBatch(texts []string) ([][]float32, error)
+	Dim() int
+	Close()
 }
 
-func NewEmbeddingService(modelPath, tokenizerPath string) (*EmbeddingService, error) {
-	ort.SetSharedLibraryPath("./model/libonnxruntime.so")
+// EmbeddingDim is the output size of the bundled all-MiniLM-L6-v2 model.
+const EmbeddingDim = 384
 
-	if err := ort.InitializeEnvironment(); err != nil {
-		return nil, fmt.Errorf("init onnx: %w", err)
-	}
+// EmbeddingService embeds text with a pool of ONNX sessions, so up to pool
+// size inferences run at the same time; further callers wait for a free
+// session. Tensors are created per call, sized to the batch and to its
+// longest text, so short queries run on short inputs.
+type EmbeddingService struct {
+	tokenizer *models.Tokenizer
+	maxTokens int
+	dim       int
+	sessions  chan *ort.DynamicAdvancedSession
+	all       []*ort.DynamicAdvancedSession
+	once      sync.Once
+}
 
-	inputShape := ort.NewShape(1, 128)
-	attShape := ort.NewShape(1, 128)
-	tokenTypeShape := ort.NewShape(1, 128)
-	outputShape := ort.NewShape(1, 128, 384)
+// NewEmbeddingService loads poolSize sessions of the model. The CPU cores
+// are split between them, so a larger pool trades per-request latency for
+// throughput under concurrent load. The embedding size is read from the
+// model's last_hidden_state output. Texts longer than maxTokens tokens are
+// truncated.
+func NewEmbeddingService(modelPath, tokenizerPath string, poolSize, maxTokens int) (*EmbeddingService, error) {
+	if poolSize < 1 {
+		poolSize = 1
+	}
+	if maxTokens < 2 {
+		return nil, fmt.Errorf("max tokens must be at least 2, got %d", maxTokens)
+	}
+	if err := acquireONNX(); err != nil {
+		return nil, err
+	}
 
-	inputIDs, err := ort.NewTensor(inputShape, make([]int64, 128))
+	dim, err := hiddenSize(modelPath)
 	if err != nil {
-		return nil, fmt.Errorf("create input tensor: %w", err)
+		releaseONNX()
+		return nil, err
 	}
 
-	attentionMask, err := ort.NewTensor(attShape, make([]int64, 128))
+	tokenizer, err := models.NewTokenizer(tokenizerPath)
 	if err != nil {
-		return nil, fmt.Errorf("create attention tensor: %w", err)
+		releaseONNX()
+		return nil, fmt.Errorf("load tokenizer: %w", err)
 	}
 
-	tokenTypeIDs, err := ort.NewTensor(tokenTypeShape, make([]int64, 128))
+	e := &EmbeddingService{
+		tokenizer: tokenizer,
+		maxTokens: maxTokens,
+		dim:       dim,
+		sessions:  make(chan *ort.DynamicAdvancedSession, poolSize),
+	}
+	threads := max(1, runtime.NumCPU()/poolSize)
+	for i := 0; i < poolSize; i++ {
+		session, err := newEmbeddingSession(modelPath, threads)
+		if err != nil {
+			e.Close()
+			return nil, fmt.Errorf("session %d: %w", i, err)
+		}
+		e.all = append(e.all, session)
+		e.sessions <- session
+	}
+	return e, nil
+}
+
+func hiddenSize(modelPath string) (int, error) {
+	_, outputs, err := ort.GetInputOutputInfo(modelPath)
 	if err != nil {
-		return nil, fmt.Errorf("create token type tensor: %w", err)
+		return 0, fmt.Errorf("read model info: %w", err)
 	}
+	for _, o := range outputs {
+		if o.Name == "last_hidden_state" && len(o.Dimensions) == 3 && o.Dimensions[2] > 0 {
+			return int(o.Dimensions[2]), nil
+		}
+	}
+	return 0, fmt.Errorf("model has no last_hidden_state output of shape [batch, seq, dim]")
+}
 
-	output, err := ort.NewTensor(outputShape, make([]float32, 128*384))
+func newEmbeddingSession(modelPath string, threads int) (*ort.DynamicAdvancedSession, error) {
+	options, err := ort.NewSessionOptions()
 	if err != nil {
-		return nil, fmt.Errorf("create output tensor: %w", err)
+		return nil, fmt.Errorf("create session options: %w", err)
+	}
+	defer options.Destroy()
+	if err := options.SetIntraOpNumThreads(threads); err != nil {
+		return nil, fmt.Errorf("set threads: %w", err)
 	}
 
-	session, err := ort.NewAdvancedSession(
+	session, err := ort.NewDynamicAdvancedSession(
 		modelPath,
 		[]string{"input_ids", "attention_mask", "token_type_ids"},
 		[]string{"last_hidden_state"},
-		[]ort.ArbitraryTensor{inputIDs, attentionMask, tokenTypeIDs},
-		[]ort.ArbitraryTensor{output},
-		nil,
+		options,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("create session: %w", err)
 	}
+	return session, nil
+}
 
-	tokenizer, err := models.NewTokenizer(tokenizerPath)
+func (e *EmbeddingService) EmbedTags(tags ...string) ([]float32, error) {
+	embeddings, err := e.EmbedBatch([]string{strings.Join(tags, " ")})
 	if err != nil {
-		return nil, fmt.Errorf("load tokenizer: %w", err)
+		return nil, err
 	}
-
-	return &EmbeddingService{
-		session:       session,
-		tokenizer:     tokenizer,
-		inputIDs:      inputIDs,
-		attentionMask: attentionMask,
-		tokenTypeIDs:  tokenTypeIDs,
-		output:        output,
-	}, nil
+	return embeddings[0], nil
 }
 
-func (e *EmbeddingService) EmbedTags(tags ...string) ([]float32, error) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+// EmbedBatch embeds all texts with a single inference on [N,seqLen]
+// inputs, seqLen being the longest text's token count. The result has one
+// normalized embedding per text, in order.
+func (e *EmbeddingService) EmbedBatch(texts []string) ([][]float32, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+	n := len(texts)
 
-	text := strings.Join(tags, " ")
+	tokens := make([][]int64, n)
+	seqLen := 0
+	for i, text := range texts {
+		ids, truncated, err := e.tokenizer.Tokenize(text, e.maxTokens)
+		if err != nil {
+			return nil, fmt.Errorf("tokenize %q: %w", text, err)
+		}
+		if truncated {
+			log.Printf("Embedding input truncated to %d tokens: %.60q", e.maxTokens, text)
+		}
+		tokens[i] = ids
+		seqLen = max(seqLen, len(ids))
+	}
+
+	inputIDs := make([]int64, n*seqLen)
+	attentionMask := make([]int64, n*seqLen)
+	for i, ids := range tokens {
+		copy(inputIDs[i*seqLen:], ids)
+		for j := range ids {
+			attentionMask[i*seqLen+j] = 1
+		}
+	}
 
-	inputIDs, attentionMask, err := e.tokenizer.Encode(text, 128)
+	shape := ort.NewShape(int64(n), int64(seqLen))
+	inputTensor, err := ort.NewTensor(shape, inputIDs)
 	if err != nil {
-		return nil, fmt.Errorf("tokenize: %w", err)
+		return nil, fmt.Errorf("create input tensor: %w", err)
 	}
+	defer inputTensor.Destroy()
 
-	copy(e.inputIDs.GetData(), inputIDs)
-	copy(e.attentionMask.GetData(), attentionMask)
+	maskTensor, err := ort.NewTensor(shape, attentionMask)
+	if err != nil {
+		return nil, fmt.Errorf("create attention tensor: %w", err)
+	}
+	defer maskTensor.Destroy()
 
-	if err := e.session.Run(); err != nil {
-		return nil, fmt.Errorf("inference: %w", err)
+	tokenTypeTensor, err := ort.NewTensor(shape, make([]int64, n*seqLen))
+	if err != nil {
+		return nil, fmt.Errorf("create token type tensor: %w", err)
 	}
+	defer tokenTypeTensor.Destroy()
 
-	embedding := meanPooling(e.output.GetData(), attentionMask, 128, 384)
-	normalize(embedding)
+	output, err := ort.NewEmptyTensor[float32](ort.NewShape(int64(n), int64(seqLen), int64(e.dim)))
+	if err != nil {
+		return nil, fmt.Errorf("create output tensor: %w", err)
+	}
+	defer output.Destroy()
 
-	return embedding, nil
+	session := <-e.sessions
+	err = session.Run(
+		[]ort.Value{inputTensor, maskTensor, tokenTypeTensor},
+		[]ort.Value{output},
+	)
+	e.sessions <- session
+	if err != nil {
+		return nil, fmt.Errorf("inference: %w", err)
+	}
+
+	stride := seqLen * e.dim
+	hidden := output.GetData()
+	embeddings := make([][]float32, n)
+	for i := range embeddings {
+		embedding := meanPooling(hidden[i*stride:(i+1)*stride],
+			attentionMask[i*seqLen:(i+1)*seqLen], seqLen, e.dim)
+		Normalize(embedding)
+		embeddings[i] = embedding
+	}
+	return embeddings, nil
 }
 
 func meanPooling(output []float32, mask []int64, seqLen, dim int) []float32 {
@@ -125,7 +228,8 @@ func meanPooling(output []float32, mask []int64, seqLen, dim int) []float32 {
 	return embedding
 }
 
-func normalize(v []float32) {
+// Normalize scales v to unit length in place.
+func Normalize(v []float32) {
 	var sum float64
 	for _, val := range v {
 		sum += float64(val * val)
@@ -136,13 +240,19 @@ func normalize(v []float32) {
 	}
 }
 
+// Dim is the length of the returned embeddings.
+func (e *EmbeddingService) Dim() int {
+	return e.dim
+}
+
+// Close destroys all sessions and the tokenizer. It must not be called while embeddings are
+// still being computed.
 func (e *EmbeddingService) Close() {
 	e.once.Do(func() {
-		e.session.Destroy()
-		e.inputIDs.Destroy()
-		e.attentionMask.Destroy()
-		e.tokenTypeIDs.Destroy()
-		e.output.Destroy()
-		ort.DestroyEnvironment()
+		for _, session := range e.all {
+			session.Destroy()
+		}
+		e.tokenizer.Close()
+		releaseONNX()
 	})
 }
@@ -0,0 +1,575 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	pgvector "github.com/pgvector/pgvector-go"
+)
+
+// modelRefreshInterval is how long the active model read from
+// embedding_models is trusted. A switch made by another instance is
+// picked up within it.
+const modelRefreshInterval = 2 * time.Second
+
+// reembedLock is the advisory lock key held while re-embedding or
+// switching, so only one instance does either at a time.
+const reembedLock = 0x696d6761 // "imga"
+
+// ErrModelSwitched means the active embedding model changed while a vector
+// was being computed. The caller should embed again.
+var ErrModelSwitched = errors.New("embedding model switched")
+
+// EmbeddingModel is an Embedder together with the name its vectors are
+// stored under.
+type EmbeddingModel struct {
+	Name     string
+	Embedder Embedder
+}
+
+// TextModels is what the handlers and the processor need of a ModelSet.
+type TextModels interface {
+	Active(ctx context.Context) (EmbeddingModel, error)
+	Composer() *TextComposer
+	EmbedImageText(ctx context.Context, title string, tags []string) (map[string][]float32, error)
+	EmbedImageTexts(ctx context.Context, titles []string, tags [][]string) ([]map[string][]float32, error)
+}
+
+// ModelSet tracks which text embedding model is active. The active model's
+// vectors live in images.embedding and it embeds search queries. While a
+// migration runs, a next model is embedded into image_embeddings next to
+// it, and replaces the active one in a single transaction once every
+// processed image has a vector (see Reembedder). Every instance loads
+// both models and follows the switch through embedding_models.
+type ModelSet struct {
+	db       DB
+	composer *TextComposer
+	mu       sync.RWMutex
+	active   EmbeddingModel
+	next     *EmbeddingModel
+	checked  time.Time // when active was last read from the database
+}
+
+// NewModelSet registers the configured models in embedding_models. On a
+// fresh database current becomes the active model. If an earlier run has
+// already switched to next, next is used as the active model. composer
+// decides which text of an image is embedded.
+func NewModelSet(ctx context.Context, db DB, current EmbeddingModel, next *EmbeddingModel, composer *TextComposer) (*ModelSet, error) {
+	s := &ModelSet{db: db, composer: composer}
+
+	if err := registerModel(ctx, db, current); err != nil {
+		return nil, err
+	}
+	_, err := db.Exec(ctx, `
+		UPDATE embedding_models SET status = 'active', activated_at = NOW()
+		WHERE name = $1
+		  AND NOT EXISTS (SELECT 1 FROM embedding_models WHERE status = 'active')
+	`, current.Name)
+	if err != nil {
+		return nil, fmt.Errorf("activate model: %w", err)
+	}
+	// rows embedded before models were tracked
+	_, err = db.Exec(ctx, `
+		UPDATE images SET embedding_model = $1
+		WHERE embedding_model IS NULL AND embedding IS NOT NULL AND thumbnail_status = 'ready'
+	`, current.Name)
+	if err != nil {
+		return nil, fmt.Errorf("tag legacy embeddings: %w", err)
+	}
+
+	var active string
+	err = db.QueryRow(ctx, "SELECT name FROM embedding_models WHERE status = 'active'").Scan(&active)
+	if err != nil {
+		return nil, fmt.Errorf("active model: %w", err)
+	}
+
+	switch {
+	case active == current.Name:
+		s.active = current
+		if next != nil && next.Name != current.Name {
+			if err := registerModel(ctx, db, *next); err != nil {
+				return nil, err
+			}
+			_, err := db.Exec(ctx, `
+				UPDATE embedding_models SET status = 'building' WHERE name = $1
+			`, next.Name)
+			if err != nil {
+				return nil, fmt.Errorf("register next model: %w", err)
+			}
+			s.next = next
+		}
+	case next != nil && active == next.Name:
+		log.Printf("Embedding model %s is already active, the old model is no longer needed", next.Name)
+		s.active = *next
+	default:
+		return nil, fmt.Errorf("database serves embedding model %q, but %q is configured", active, current.Name)
+	}
+
+	if err := s.fitColumn(ctx); err != nil {
+		return nil, err
+	}
+	s.checked = time.Now()
+	return s, nil
+}
+
+// fitColumn resizes images.embedding to the active model's dimensions. A
+// fresh database starts out with vector(384); once vectors are stored,
+// only a switch may change the type.
+func (s *ModelSet) fitColumn(ctx context.Context) error {
+	var columnDim int
+	err := s.db.QueryRow(ctx, `
+		SELECT atttypmod FROM pg_attribute
+		WHERE attrelid = 'images'::regclass AND attname = 'embedding'
+	`).Scan(&columnDim)
+	if err != nil {
+		return fmt.Errorf("embedding column: %w", err)
+	}
+	dim := s.active.Embedder.Dim()
+	if columnDim == dim {
+		return nil
+	}
+
+	var stored bool
+	err = s.db.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM images WHERE embedding IS NOT NULL)
+	`).Scan(&stored)
+	if err != nil {
+		return fmt.Errorf("embedding column: %w", err)
+	}
+	if stored {
+		return fmt.Errorf("embedding column has %d dimensions, model %s needs %d", columnDim, s.active.Name, dim)
+	}
+
+	_, err = s.db.Exec(ctx, fmt.Sprintf(`
+		ALTER TABLE images ALTER COLUMN embedding TYPE vector(%d)
+	`, dim))
+	if err != nil {
+		return fmt.Errorf("resize embedding column: %w", err)
+	}
+	return nil
+}
+
+func registerModel(ctx context.Context, db DB, m EmbeddingModel) error {
+	var dim int
+	err := db.QueryRow(ctx, `
+		INSERT INTO embedding_models (name, dim) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+		RETURNING dim
+	`, m.Name, m.Embedder.Dim()).Scan(&dim)
+	if err != nil {
+		return fmt.Errorf("register model %s: %w", m.Name, err)
+	}
+	if dim != m.Embedder.Dim() {
+		return fmt.Errorf("model %s was registered with %d dimensions, but produces %d", m.Name, dim, m.Embedder.Dim())
+	}
+	return nil
+}
+
+// refresh re-reads the active model once modelRefreshInterval has passed,
+// so that a switch made by another instance applies here as well.
+func (s *ModelSet) refresh(ctx context.Context) error {
+	s.mu.RLock()
+	fresh := time.Since(s.checked) < modelRefreshInterval
+	s.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	var active string
+	err := s.db.QueryRow(ctx, `
+		SELECT name FROM embedding_models WHERE status = 'active'
+	`).Scan(&active)
+	if err != nil {
+		return fmt.Errorf("active model: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case active == s.active.Name:
+	case s.next != nil && active == s.next.Name:
+		log.Printf("Embedding model %s was activated by another instance", active)
+		s.active, s.next = *s.next, nil
+	default:
+		return fmt.Errorf("database serves embedding model %q, which is not configured", active)
+	}
+	s.checked = time.Now()
+	return nil
+}
+
+// Active is the model that embeds search queries.
+func (s *ModelSet) Active(ctx context.Context) (EmbeddingModel, error) {
+	if err := s.refresh(ctx); err != nil {
+		return EmbeddingModel{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.active, nil
+}
+
+// Next is the model being migrated to, or nil.
+func (s *ModelSet) Next() *EmbeddingModel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.next
+}
+
+// All is the active model followed by the next one, if any. New and
+// edited images are embedded with all of them.
+func (s *ModelSet) All() []EmbeddingModel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.next == nil {
+		return []EmbeddingModel{s.active}
+	}
+	return []EmbeddingModel{s.active, *s.next}
+}
+
+// Composer is the text composition used for image vectors.
+func (s *ModelSet) Composer() *TextComposer {
+	return s.composer
+}
+
+// EmbedImageText embeds the title and tags of an image with every model in
+// the set, keyed by model name.
+func (s *ModelSet) EmbedImageText(ctx context.Context, title string, tags []string) (map[string][]float32, error) {
+	if err := s.refresh(ctx); err != nil {
+		return nil, err
+	}
+	vectors := make(map[string][]float32)
+	for _, m := range s.All() {
+		vec, err := s.composer.Embed(m.Embedder, title, tags)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", m.Name, err)
+		}
+		vectors[m.Name] = vec
+	}
+	return vectors, nil
+}
+
+// EmbedImageTexts embeds the titles and tags of several images with one
+// batch per model of the set. The result has one map per image, keyed by
+// model name.
+func (s *ModelSet) EmbedImageTexts(ctx context.Context, titles []string, tags [][]string) ([]map[string][]float32, error) {
+	if err := s.refresh(ctx); err != nil {
+		return nil, err
+	}
+	vectors := make([]map[string][]float32, len(titles))
+	for i := range vectors {
+		vectors[i] = make(map[string][]float32)
+	}
+	for _, m := range s.All() {
+		embeddings, err := s.composer.EmbedBatch(m.Embedder, titles, tags)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", m.Name, err)
+		}
+		for i := range vectors {
+			vectors[i][m.Name] = embeddings[i]
+		}
+	}
+	return vectors, nil
+}
+
+// LockActiveModel locks the active model row for share and returns its
+// name, so a switch waits until tx is done. Writers take it before they
+// lock any image row; the switch locks the model first and then every
+// image, the same order keeps them from deadlocking.
+func LockActiveModel(ctx context.Context, tx pgx.Tx) (string, error) {
+	var active string
+	err := tx.QueryRow(ctx, `
+		SELECT name FROM embedding_models WHERE status = 'active' FOR SHARE
+	`).Scan(&active)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrModelSwitched
+	}
+	if err != nil {
+		return "", fmt.Errorf("active model: %w", err)
+	}
+	return active, nil
+}
+
+// WriteTextEmbeddings stores the vectors of one image inside tx: the active
+// model's goes to images.embedding, the one of a model being built to
+// image_embeddings along with the title and tags it was computed from. Both
+// are read from embedding_models, not taken from the caller's ModelSet,
+// which may lag behind a switch by another instance. The active model row
+// is locked (see LockActiveModel); if it is not in vectors,
+// ErrModelSwitched is returned.
+func WriteTextEmbeddings(ctx context.Context, tx pgx.Tx, imageID int64, title string, tags []string, vectors map[string][]float32) error {
+	active, err := LockActiveModel(ctx, tx)
+	if err != nil {
+		return err
+	}
+	vec, ok := vectors[active]
+	if !ok {
+		return ErrModelSwitched
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE images SET embedding = $1, embedding_model = $2 WHERE id = $3
+	`, pgvector.NewVector(vec), active, imageID)
+	if err != nil {
+		return fmt.Errorf("update embedding: %w", err)
+	}
+
+	for name, vec := range vectors {
+		if name == active {
+			continue
+		}
+		// vectors of a retired model are not kept up to date
+		_, err := tx.Exec(ctx, `
+			INSERT INTO image_embeddings (image_id, model, embedding, title, tags)
+			SELECT $1, name, $3, $4, $5 FROM embedding_models
+			WHERE name = $2 AND status = 'building'
+			ON CONFLICT (image_id, model) DO UPDATE
+			SET embedding = EXCLUDED.embedding, title = EXCLUDED.title, tags = EXCLUDED.tags
+		`, imageID, name, pgvector.NewVector(vec), title, tags)
+		if err != nil {
+			return fmt.Errorf("store %s embedding: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// stageColumn prepares images.embedding_next, with its HNSW index, if the
+// next model's vectors do not fit images.embedding. Both are created while
+// the column is still empty, which is quick, and the backfill fills it
+// alongside image_embeddings; the switch then swaps the columns instead
+// of rewriting the table. It reports whether the column is in use.
+func (s *ModelSet) stageColumn(ctx context.Context) (bool, error) {
+	next := s.Next()
+	if next == nil {
+		return false, nil
+	}
+	dims, err := columnDims(ctx, s.db)
+	if err != nil {
+		return false, err
+	}
+	dim := next.Embedder.Dim()
+	if dims["embedding"] == dim {
+		return false, nil
+	}
+	if dims["embedding_next"] == dim {
+		return true, nil
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// left over from a migration to a model of other dimensions
+	if _, ok := dims["embedding_next"]; ok {
+		if _, err := tx.Exec(ctx, "ALTER TABLE images DROP COLUMN IF EXISTS embedding_next"); err != nil {
+			return false, fmt.Errorf("drop staging column: %w", err)
+		}
+	}
+	// dim is an int we control
+	_, err = tx.Exec(ctx, fmt.Sprintf(`
+		ALTER TABLE images ADD COLUMN IF NOT EXISTS embedding_next vector(%d);
+		CREATE INDEX IF NOT EXISTS images_embedding_next_idx
+			ON images USING hnsw (embedding_next vector_cosine_ops);
+	`, dim))
+	if err != nil {
+		return false, fmt.Errorf("add staging column: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("commit: %w", err)
+	}
+	return true, nil
+}
+
+// columnDims returns the dimensions of the vector columns of images that
+// hold text embeddings.
+func columnDims(ctx context.Context, db DB) (map[string]int, error) {
+	rows, err := db.Query(ctx, `
+		SELECT attname, atttypmod FROM pg_attribute
+		WHERE attrelid = 'images'::regclass AND attname IN ('embedding', 'embedding_next')
+		  AND NOT attisdropped
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("embedding columns: %w", err)
+	}
+	dims := make(map[string]int)
+	for rows.Next() {
+		var name string
+		var dim int
+		if err := rows.Scan(&name, &dim); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("embedding columns: %w", err)
+		}
+		dims[name] = dim
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("embedding columns: %w", err)
+	}
+	return dims, nil
+}
+
+// switchToNext makes the next model active if every processed image has a
+// current vector for it. Everything happens in one transaction: the old vectors are
+// kept in image_embeddings, the new ones move into images.embedding (or,
+// if the dimensions differ, images.embedding_next, which then replaces
+// it, see stageColumn) and the model statuses flip. It reports whether the
+// switch happened, which it does not while another instance holds the
+// re-embed lock.
+func (s *ModelSet) switchToNext(ctx context.Context) (bool, error) {
+	next := s.Next()
+	if next == nil {
+		return false, nil
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if locked, err := tryReembedLock(ctx, tx, next.Name); err != nil || !locked {
+		return false, err
+	}
+
+	// waits for writers holding the active row (see WriteTextEmbeddings)
+	var oldName string
+	var oldDim int
+	err = tx.QueryRow(ctx, `
+		UPDATE embedding_models SET status = 'retired'
+		WHERE status = 'active'
+		RETURNING name, dim
+	`).Scan(&oldName, &oldDim)
+	if err != nil {
+		return false, fmt.Errorf("retire active model: %w", err)
+	}
+
+	var missing int64
+	err = tx.QueryRow(ctx, `
+		SELECT count(*) FROM images i
+		WHERE i.embedding_model IS NOT NULL
+		  AND NOT EXISTS (
+			SELECT 1 FROM image_embeddings e
+			WHERE e.image_id = i.id AND e.model = $1
+			  AND e.title = i.title AND e.tags = i.tags
+		  )
+	`, next.Name).Scan(&missing)
+	if err != nil {
+		return false, fmt.Errorf("coverage: %w", err)
+	}
+	if missing > 0 {
+		return false, nil
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO image_embeddings (image_id, model, embedding, title, tags)
+		SELECT id, embedding_model, embedding, title, tags FROM images
+		WHERE embedding_model IS NOT NULL
+		ON CONFLICT (image_id, model) DO UPDATE
+		SET embedding = EXCLUDED.embedding, title = EXCLUDED.title, tags = EXCLUDED.tags
+	`)
+	if err != nil {
+		return false, fmt.Errorf("keep old embeddings: %w", err)
+	}
+
+	if dim := next.Embedder.Dim(); dim != oldDim {
+		err = swapColumn(ctx, tx, next.Name, dim)
+	} else {
+		_, err = tx.Exec(ctx, `
+			UPDATE images i
+			SET embedding = e.embedding, embedding_model = e.model
+			FROM image_embeddings e
+			WHERE e.image_id = i.id AND e.model = $1
+		`, next.Name)
+	}
+	if err != nil {
+		return false, fmt.Errorf("move embeddings: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		DELETE FROM image_embeddings WHERE model = $1
+	`, next.Name)
+	if err != nil {
+		return false, fmt.Errorf("clean up embeddings: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE embedding_models SET status = 'active', activated_at = NOW()
+		WHERE name = $1
+	`, next.Name)
+	if err != nil {
+		return false, fmt.Errorf("activate model: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("commit: %w", err)
+	}
+
+	s.mu.Lock()
+	s.active, s.next = *next, nil
+	s.checked = time.Now()
+	s.mu.Unlock()
+
+	log.Printf("Switched embedding model from %s to %s", oldName, next.Name)
+	return true, nil
+}
+
+// swapColumn replaces images.embedding with the staged embedding_next
+// inside the switch transaction. The backfill has filled most of it; only
+// vectors the processor wrote since are copied over. Dropping and renaming
+// columns touch the catalog only, neither rewrites the table nor rebuilds
+// an index.
+func swapColumn(ctx context.Context, tx pgx.Tx, model string, dim int) error {
+	dims, err := columnDims(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if dims["embedding_next"] != dim {
+		return fmt.Errorf("no staged column with %d dimensions", dim)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE images i
+		SET embedding_next = e.embedding
+		FROM image_embeddings e
+		WHERE e.image_id = i.id AND e.model = $1
+		  AND i.embedding_next IS DISTINCT FROM e.embedding
+	`, model)
+	if err != nil {
+		return fmt.Errorf("fill staging column: %w", err)
+	}
+	_, err = tx.Exec(ctx, `
+		ALTER TABLE images DROP COLUMN embedding;
+		ALTER TABLE images RENAME COLUMN embedding_next TO embedding;
+		ALTER INDEX images_embedding_next_idx RENAME TO images_embedding_idx;
+	`)
+	if err != nil {
+		return fmt.Errorf("swap columns: %w", err)
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE images SET embedding_model = $1 WHERE embedding_model IS NOT NULL
+	`, model)
+	if err != nil {
+		return fmt.Errorf("tag embeddings: %w", err)
+	}
+	return nil
+}
+
+// tryReembedLock takes the re-embed lock for the rest of tx. It reports
+// false if another instance holds it, or if next is no longer being built
+// because another instance has switched to it.
+func tryReembedLock(ctx context.Context, tx pgx.Tx, next string) (bool, error) {
+	var locked bool
+	err := tx.QueryRow(ctx, `
+		SELECT pg_try_advisory_xact_lock($1)
+		   AND EXISTS (SELECT 1 FROM embedding_models WHERE name = $2 AND status = 'building')
+	`, reembedLock, next).Scan(&locked)
+	if err != nil {
+		return false, fmt.Errorf("re-embed lock: %w", err)
+	}
+	return locked, nil
+}
@@ -0,0 +1,129 @@
+package services_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"imageapp/internal/services"
+	"imageapp/internal/testdb"
+)
+
+func TestModelSwitchReachesOtherInstances(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.New(t)
+	composer, err := services.NewTextComposer("tags", 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := services.EmbeddingModel{Name: "old", Embedder: services.NewFakeEmbedder(services.EmbeddingDim)}
+	next := services.EmbeddingModel{Name: "new", Embedder: services.NewFakeEmbedder(64)}
+
+	// two instances with the same configuration
+	a, err := services.NewModelSet(ctx, db, current, &next, composer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := services.NewModelSet(ctx, db, current, &next, composer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one processed image, embedded with both models
+	var id int64
+	err = db.QueryRow(ctx, `
+		INSERT INTO images (title, tags, filename, size, mime, checksum, storage_path, image_url, thumbnail_status)
+		VALUES ('t', '{beach}', 't.png', 1, 'image/png', 'c', 'originals/t.png', '/uploads/t.png', 'ready')
+		RETURNING id
+	`).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors, err := b.EmbedImageText(ctx, "t", []string{"beach"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := services.WriteTextEmbeddings(ctx, tx, id, "t", []string{"beach"}, vectors); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// only a migrates and switches
+	r := services.NewReembedder(db, a, 10)
+	defer r.Shutdown()
+	waitFor(t, func() bool { return a.Next() == nil })
+
+	// b follows within the refresh interval
+	waitFor(t, func() bool {
+		m, err := b.Active(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.Name == "new"
+	})
+	vectors, err = b.EmbedImageText(ctx, "t", []string{"beach", "sea"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := vectors["old"]; ok || len(vectors) != 1 {
+		t.Errorf("b still embeds with the retired model: %v", keys(vectors))
+	}
+
+	var model string
+	if err := db.QueryRow(ctx, "SELECT embedding_model FROM images WHERE id = $1", id).Scan(&model); err != nil {
+		t.Fatal(err)
+	}
+	if model != "new" {
+		t.Errorf("image embedded with %q after the switch, want new", model)
+	}
+
+	// the staged column replaced the old one, index included
+	var dim int
+	var staged, indexed bool
+	err = db.QueryRow(ctx, `
+		SELECT
+			(SELECT atttypmod FROM pg_attribute
+			 WHERE attrelid = 'images'::regclass AND attname = 'embedding'),
+			EXISTS (SELECT 1 FROM pg_attribute
+			 WHERE attrelid = 'images'::regclass AND attname = 'embedding_next' AND NOT attisdropped),
+			EXISTS (SELECT 1 FROM pg_indexes WHERE indexname = 'images_embedding_idx')
+	`).Scan(&dim, &staged, &indexed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dim != 64 || staged || !indexed {
+		t.Errorf("after the switch: embedding has %d dimensions, staging column left: %t, indexed: %t", dim, staged, indexed)
+	}
+	var stored bool
+	if err := db.QueryRow(ctx, "SELECT embedding IS NOT NULL FROM images WHERE id = $1", id).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !stored {
+		t.Error("image lost its vector in the switch")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(15 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func keys(m map[string][]float32) []string {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+var benchmarkTags = []string{
+	"beach sunset", "golden retriever", "mountain lake", "city at night",
+	"red sports car", "snowy forest", "street food market", "portrait",
+}
+
+// BenchmarkEmbed embeds single queries from parallel goroutines, the way
+// concurrent searches use the service, with different session pool sizes.
+// It needs the model in backend/model and is skipped without it.
+func BenchmarkEmbed(b *testing.B) {
+	// the onnxruntime library path is relative to backend/
+	b.Chdir("../..")
+	for _, file := range []string{"model/model.onnx", "model/tokenizer.json", "model/libonnxruntime.so"} {
+		if _, err := os.Stat(file); err != nil {
+			b.Skipf("model files missing: %v", err)
+		}
+	}
+
+	for _, poolSize := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("pool=%d", poolSize), func(b *testing.B) {
+			e, err := NewEmbeddingService("model/model.onnx", "model/tokenizer.json", poolSize, 128)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer e.Close()
+
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					tags := benchmarkTags[next.Add(1)%int64(len(benchmarkTags))]
+					if _, err := e.EmbedTags(tags); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"image"
+	"io"
+	"strings"
+
+	"imageapp/internal/models"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// ExtractMetadata reads camera, lens, capture time and GPS from the EXIF
+// block, if there is one. Dimensions are taken from the decoded, upright
+// image.
+func ExtractMetadata(r io.Reader, img image.Image) *models.ImageMetadata {
+	meta := &models.ImageMetadata{
+		Width:  img.Bounds().Dx(),
+		Height: img.Bounds().Dy(),
+	}
+
+	x, err := exif.Decode(r)
+	if err != nil {
+		// no or broken EXIF is normal for PNGs, screenshots etc.
+		return meta
+	}
+
+	meta.CameraMake = exifString(x, exif.Make)
+	meta.CameraModel = exifString(x, exif.Model)
+	meta.Lens = exifString(x, exif.LensModel)
+
+	if t, err := x.DateTime(); err == nil {
+		meta.TakenAt = &t
+	}
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		if v, err := tag.Int(0); err == nil {
+			meta.Orientation = v
+		}
+	}
+	if lat, lon, err := x.LatLong(); err == nil {
+		meta.GPS = &models.GPS{Latitude: lat, Longitude: lon}
+		if tag, err := x.Get(exif.GPSAltitude); err == nil {
+			if rat, err := tag.Rat(0); err == nil {
+				alt, _ := rat.Float64()
+				if ref, err := x.Get(exif.GPSAltitudeRef); err == nil {
+					if v, err := ref.Int(0); err == nil && v == 1 {
+						alt = -alt // below sea level
+					}
+				}
+				meta.GPS.Altitude = &alt
+			}
+		}
+	}
+
+	return meta
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.Trim(s, "\x00"))
+}
@@ -0,0 +1,16 @@
+package services
+
+// NewTestQueue returns a processor without workers, so tests can drive
+// the job queue themselves.
+func NewTestQueue(db DB, cfg ProcessorConfig) *ImageProcessor {
+	cfg.setDefaults()
+	return &ImageProcessor{db: db, cfg: cfg}
+}
+
+var (
+	ClaimJobs    = (*ImageProcessor).claimJobs
+	CompleteJob  = (*ImageProcessor).completeJob
+	FailJob      = (*ImageProcessor).failJob
+	Backoff      = (*ImageProcessor).backoff
+	ErrLeaseLost = errLeaseLost
+)
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"hash/fnv"
+	"strings"
+)
+
+// FakeEmbedder is a deterministic Embedder that needs no model: every word
+// is hashed to a dimension and a sign, the counts are normalized. Texts
+// that share words end up close together, so search behaves plausibly in
+// tests and local development.
+type FakeEmbedder struct {
+	dim int
+}
+
+func NewFakeEmbedder(dim int) *FakeEmbedder {
+	return &FakeEmbedder{dim: dim}
+}
+
+func (f *FakeEmbedder) EmbedTags(tags ...string) ([]float32, error) {
+	return f.embed(strings.Join(tags, " ")), nil
+}
+
+func (f *FakeEmbedder) EmbedBatch(texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(texts))
+	for i, text := range texts {
+		embeddings[i] = f.embed(text)
+	}
+	return embeddings, nil
+}
+
+func (f *FakeEmbedder) Dim() int {
+	return f.dim
+}
+
+func (f *FakeEmbedder) Close() {}
+
+func (f *FakeEmbedder) embed(text string) []float32 {
+	v := make([]float32, f.dim)
+	words := strings.Fields(strings.ToLower(text))
+	if len(words) == 0 {
+		// keep the vector non-zero, cosine distance is undefined otherwise
+		words = []string{""}
+	}
+	for _, word := range words {
+		h := fnv.New64a()
+		h.Write([]byte(word))
+		sum := h.Sum64()
+		sign := float32(1)
+		if sum&1 == 1 {
+			sign = -1
+		}
+		v[(sum>>1)%uint64(f.dim)] += sign
+	}
+	Normalize(v)
+	return v
+}
@@ -0,0 +1,40 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// The onnxruntime environment is process-wide, but several services run
+// their own sessions in it. It is created with the first and destroyed
+// with the last user.
+var (
+	ortMu   sync.Mutex
+	ortRefs int
+)
+
+func acquireONNX() error {
+	ortMu.Lock()
+	defer ortMu.Unlock()
+
+	if ortRefs == 0 {
+		ort.SetSharedLibraryPath("./model/libonnxruntime.so")
+		if err := ort.InitializeEnvironment(); err != nil {
+			return fmt.Errorf("init onnx: %w", err)
+		}
+	}
+	ortRefs++
+	return nil
+}
+
+func releaseONNX() {
+	ortMu.Lock()
+	defer ortMu.Unlock()
+
+	ortRefs--
+	if ortRefs == 0 {
+		ort.DestroyEnvironment()
+	}
+}
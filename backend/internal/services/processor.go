@@ -2,47 +2,121 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"image"
+	"io"
 	"log"
 	"os"
-	"path/filepath"
+	"slices"
 	"sync"
+	"time"
 
-	"github.com/disintegration/imaging"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"imageapp/internal/models"
+	"imageapp/internal/storage"
+
+	"github.com/jackc/pgx/v5"
 	pgvector "github.com/pgvector/pgvector-go"
 )
 
+// errImageGone means the image was deleted while its job ran.
+var errImageGone = errors.New("image was deleted")
+
 type ImageJob struct {
-	FileID   int64
-	FilePath string
-	Filename string
-	Title    string
-	Tags     []string
+	FileID     int64
+	StorageKey string
+	Filename   string
+	Title      string
+	Tags       []string
+	Attempts   int
 }
 
 type OnComplete func(job ImageJob)
+
+// ProcessorConfig controls the worker pool and the job queue polling.
+type ProcessorConfig struct {
+	Workers      int
+	PollInterval time.Duration // how often idle workers look for new jobs
+	Lease        time.Duration // how long a claimed job is reserved for one worker
+	MaxAttempts  int           // attempts before a job is moved to 'dead'
+	BackoffBase  time.Duration // delay before the first retry, doubled per attempt
+	BackoffMax   time.Duration // upper bound for the retry delay
+	Renditions   []Rendition   // derived sizes stored next to the original
+	Thumbnail    string        // name of the rendition used as thumbnail
+	MaxPixels    int           // larger images are rejected before decoding
+	BatchSize    int           // most jobs one worker claims and embeds together
+	BatchWindow  time.Duration // how long a worker waits for more jobs to join a batch
+}
+
+func (c *ProcessorConfig) setDefaults() {
+	if c.Workers <= 0 {
+		c.Workers = 3
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = 2 * time.Second
+	}
+	if c.Lease <= 0 {
+		c.Lease = 5 * time.Minute
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 5
+	}
+	if c.BackoffBase <= 0 {
+		c.BackoffBase = 10 * time.Second
+	}
+	if c.BackoffMax <= 0 {
+		c.BackoffMax = 30 * time.Minute
+	}
+	if c.Renditions == nil {
+		c.Renditions = DefaultRenditions
+	}
+	if c.Thumbnail == "" {
+		c.Thumbnail = "sq512"
+	}
+	if c.MaxPixels <= 0 {
+		c.MaxPixels = DefaultMaxPixels
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 8
+	}
+	if c.BatchWindow < 0 {
+		c.BatchWindow = 0
+	}
+}
+
 type ImageProcessor struct {
-	jobs       chan ImageJob
+	wake       chan struct{}
+	done       chan struct{}
 	wg         sync.WaitGroup
-	db         *pgxpool.Pool
-	thumbDir   string
-	maxWorkers int
-	embedder   *EmbeddingService
+	db         DB
+	store      storage.Storage
+	cfg        ProcessorConfig
+	instanceID string
+	models     TextModels
+	clip       VisualEncoder
+	tagger     Tagger
 	onComplete OnComplete
 	once       sync.Once
 }
 
-func NewImageProcessor(db *pgxpool.Pool, baseDir string, maxWorkers int, embedder *EmbeddingService, onComplete OnComplete) *ImageProcessor {
-	thumbDir := filepath.Join(baseDir, "thumbnails")
-	os.MkdirAll(thumbDir, 0o755)
+// NewImageProcessor starts the workers. Tags are embedded with every model
+// in models. clip may be nil, then no content embeddings are computed.
+// tagger may be nil, then no tags are suggested.
+func NewImageProcessor(db DB, store storage.Storage, cfg ProcessorConfig, models TextModels, clip VisualEncoder, tagger Tagger, onComplete OnComplete) *ImageProcessor {
+	cfg.setDefaults()
+
+	host, _ := os.Hostname()
 
 	p := &ImageProcessor{
-		jobs:       make(chan ImageJob, 100),
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
 		db:         db,
-		thumbDir:   thumbDir,
-		maxWorkers: maxWorkers,
-		embedder:   embedder,
+		store:      store,
+		cfg:        cfg,
+		instanceID: fmt.Sprintf("%s:%d", host, os.Getpid()),
+		models:     models,
+		clip:       clip,
+		tagger:     tagger,
 		onComplete: onComplete,
 	}
 
@@ -51,7 +125,7 @@ func NewImageProcessor(db *pgxpool.Pool, baseDir string, maxWorkers int, embedde
 }
 
 func (p *ImageProcessor) startWorkers() {
-	for i := 0; i < p.maxWorkers; i++ {
+	for i := 0; i < p.cfg.Workers; i++ {
 		p.wg.Add(1)
 		go p.worker(i)
 	}
@@ -60,60 +134,274 @@ func (p *ImageProcessor) startWorkers() {
 func (p *ImageProcessor) worker(id int) {
 	defer p.wg.Done()
 
-	for job := range p.jobs {
-		if err := p.processJob(job); err != nil {
-			log.Printf("Worker %d: processing failed for file %d: %v", id, job.FileID, err)
-			p.updateStatus(job.FileID, "failed")
+	workerID := fmt.Sprintf("%s:%d", p.instanceID, id)
+	ticker := time.NewTicker(p.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		// drain the queue before going back to sleep
+		for p.runBatch(id, workerID) {
+			select {
+			case <-p.done:
+				return
+			default:
+			}
+		}
+
+		select {
+		case <-p.done:
+			return
+		case <-p.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// preparedJob is a job whose image work is done: renditions stored and
+// content embedded. Only the text embedding and the database write are
+// left.
+type preparedJob struct {
+	job      ImageJob
+	thumbKey string
+	meta     *models.ImageMetadata
+	vec      []float32 // content embedding, nil without CLIP
+}
+
+// runBatch claims the jobs that are queued or arrive within BatchWindow,
+// at most BatchSize, processes their images one after the other and
+// embeds all their texts with one batch per model. It reports whether any
+// job was found, so the worker knows to keep going.
+func (p *ImageProcessor) runBatch(id int, workerID string) bool {
+	ctx := context.Background()
+
+	jobs, err := p.claimBatch(ctx, workerID)
+	if err != nil {
+		log.Printf("Worker %d: %v", id, err)
+	}
+	if len(jobs) == 0 {
+		return false
+	}
+
+	var prepared []preparedJob
+	for len(jobs) > 0 {
+		job := jobs[0]
+		jobs = jobs[1:]
+		if job.Attempts > p.cfg.MaxAttempts {
+			// the lease ran out on every attempt, e.g. the process crashed on this image
+			p.finishJob(id, workerID, job, fmt.Errorf("gave up after %d attempts", p.cfg.MaxAttempts))
+		} else if pj, err := p.prepareJob(job); err != nil {
+			p.finishJob(id, workerID, job, err)
 		} else {
-			log.Printf("Worker %d: processing complete for file %d", id, job.FileID)
+			prepared = append(prepared, pj)
+		}
 
-			if p.onComplete != nil {
-				p.onComplete(job)
+		// the rest of the batch must not be taken over while this worker
+		// is still busy with it
+		waiting := slices.Clone(jobs)
+		for _, pj := range prepared {
+			waiting = append(waiting, pj.job)
+		}
+		held, err := p.extendLease(ctx, workerID, waiting)
+		if err != nil {
+			log.Printf("Worker %d: %v", id, err)
+			continue
+		}
+		lost := func(job ImageJob) bool {
+			if !held[job.FileID] {
+				log.Printf("Worker %d: lost the lease on job %d, it will run again", id, job.FileID)
 			}
+			return !held[job.FileID]
+		}
+		jobs = slices.DeleteFunc(jobs, lost)
+		prepared = slices.DeleteFunc(prepared, func(pj preparedJob) bool { return lost(pj.job) })
+	}
+	if len(prepared) == 0 {
+		return true
+	}
+
+	titles := make([]string, len(prepared))
+	tags := make([][]string, len(prepared))
+	for i, pj := range prepared {
+		titles[i], tags[i] = pj.job.Title, pj.job.Tags
+	}
+	vectors, err := p.models.EmbedImageTexts(ctx, titles, tags)
+	for i, pj := range prepared {
+		if err != nil {
+			p.finishJob(id, workerID, pj.job, fmt.Errorf("embedding: %w", err))
+			continue
+		}
+		p.finishJob(id, workerID, pj.job, p.saveJob(&pj, vectors[i]))
+	}
+	return true
+}
+
+// finishJob completes the job, or records jobErr if it is not nil.
+func (p *ImageProcessor) finishJob(id int, workerID string, job ImageJob, jobErr error) {
+	ctx := context.Background()
+
+	if errors.Is(jobErr, errImageGone) {
+		// the job went with the row; only the renditions written since are left
+		log.Printf("Worker %d: file %d was deleted while processing", id, job.FileID)
+		p.removeRenditions(ctx, job.FileID)
+		return
+	}
+
+	if jobErr != nil {
+		log.Printf("Worker %d: processing failed for file %d (attempt %d): %v", id, job.FileID, job.Attempts, jobErr)
+		dead, err := p.failJob(ctx, job, workerID, jobErr)
+		if errors.Is(err, errLeaseLost) {
+			// the worker that took over sets the status
+			log.Printf("Worker %d: lost the lease on job %d, failure not recorded", id, job.FileID)
+			return
 		}
+		if err != nil {
+			log.Printf("Worker %d: failed to record failure of job %d: %v", id, job.FileID, err)
+		}
+		if dead {
+			p.updateStatus(job.FileID, "failed")
+		} else {
+			p.updateStatus(job.FileID, "pending")
+		}
+		return
+	}
+
+	log.Printf("Worker %d: processing complete for file %d", id, job.FileID)
+	if err := p.completeJob(ctx, job.FileID, workerID); errors.Is(err, errLeaseLost) {
+		log.Printf("Worker %d: lost the lease on job %d, it will run again", id, job.FileID)
+	} else if err != nil {
+		log.Printf("Worker %d: failed to complete job %d: %v", id, job.FileID, err)
+	}
+
+	if p.onComplete != nil {
+		p.onComplete(job)
 	}
 }
-func (p *ImageProcessor) processJob(job ImageJob) error {
+
+// prepareJob does the image work of a job. The decoded image is dropped
+// afterwards, a batch only keeps what is needed for the database write.
+func (p *ImageProcessor) prepareJob(job ImageJob) (preparedJob, error) {
 	p.updateStatus(job.FileID, "processing")
 
-	thumbPath, err := p.createThumbnail(job)
+	src, meta, err := p.loadImage(job)
+	if err != nil {
+		return preparedJob{}, err
+	}
+
+	thumbKey, err := p.createRenditions(job, src)
+	if err != nil {
+		return preparedJob{}, fmt.Errorf("renditions: %w", err)
+	}
+
+	var vec []float32
+	if p.clip != nil {
+		vec, err = p.clip.EmbedImage(src)
+		if err != nil {
+			return preparedJob{}, fmt.Errorf("image embedding: %w", err)
+		}
+	}
+	return preparedJob{job: job, thumbKey: thumbKey, meta: meta, vec: vec}, nil
+}
+
+// saveJob writes the results of a prepared job. If title or tags were
+// edited meanwhile, pj.job is updated to them.
+func (p *ImageProcessor) saveJob(pj *preparedJob, vectors map[string][]float32) error {
+	ctx := context.Background()
+	tx, err := p.db.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("thumbnail: %w", err)
+		return fmt.Errorf("begin tx: %w", err)
 	}
+	defer tx.Rollback(ctx)
 
-	embedding, err := p.embedder.EmbedTags(job.Tags...)
+	// first, so a model switch waits for this transaction (or wins and
+	// the job is retried with the new model)
+	if _, err := LockActiveModel(ctx, tx); err != nil {
+		return err
+	}
+
+	// title and tags may have been edited while the job ran; the vectors
+	// and suggestions must match what is stored now, not the job's copy
+	job := &pj.job
+	var title string
+	var tags, rejected []string
+	err = tx.QueryRow(ctx, `
+		SELECT title, tags, rejected_tags FROM images WHERE id = $1 FOR UPDATE
+	`, job.FileID).Scan(&title, &tags, &rejected)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errImageGone
+	}
 	if err != nil {
-		return fmt.Errorf("embedding: %w", err)
+		return fmt.Errorf("lock image: %w", err)
+	}
+	if title != job.Title || !slices.Equal(tags, job.Tags) {
+		vectors, err = p.models.EmbedImageText(ctx, title, tags)
+		if err != nil {
+			return fmt.Errorf("embedding: %w", err)
+		}
+		job.Title, job.Tags = title, tags
+	}
+
+	var imageEmbedding *pgvector.Vector
+	var suggestedTags *[]models.SuggestedTag
+	if pj.vec != nil {
+		v := pgvector.NewVector(pj.vec)
+		imageEmbedding = &v
+		if p.tagger != nil {
+			suggestions := p.tagger.Suggest(pj.vec, job.Tags, rejected)
+			suggestedTags = &suggestions
+		}
 	}
 
-	_, err = p.db.Exec(context.Background(), `
+	if err := WriteTextEmbeddings(ctx, tx, job.FileID, job.Title, job.Tags, vectors); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
 		UPDATE images 
 		SET thumbnail_path = $1,
 		    thumbnail_status = 'ready',
-		    embedding = $2
-		WHERE id = $3
-	`, thumbPath, pgvector.NewVector(embedding), job.FileID)
+		    metadata = $2,
+		    image_embedding = COALESCE($3, image_embedding),
+		    suggested_tags = COALESCE($4, suggested_tags)
+		WHERE id = $5
+	`, pj.thumbKey, pj.meta, imageEmbedding, suggestedTags, job.FileID)
 	if err != nil {
 		return fmt.Errorf("db update: %w", err)
 	}
 
-	return nil
+	return tx.Commit(ctx)
 }
 
-func (p *ImageProcessor) createThumbnail(job ImageJob) (string, error) {
-	src, err := imaging.Open(job.FilePath)
-	if err != nil {
-		return "", fmt.Errorf("open image: %w", err)
+// removeRenditions deletes every rendition an image may have, for an
+// image that was deleted while it was processed.
+func (p *ImageProcessor) removeRenditions(ctx context.Context, imageID int64) {
+	if _, err := p.db.Exec(ctx, "DELETE FROM image_renditions WHERE image_id = $1", imageID); err != nil {
+		log.Printf("Failed to remove renditions of image %d: %v", imageID, err)
 	}
+	for _, r := range p.cfg.Renditions {
+		if err := p.store.Delete(ctx, RenditionKey(imageID, r.Name)); err != nil {
+			log.Printf("Failed to remove rendition %s of image %d: %v", r.Name, imageID, err)
+		}
+	}
+}
 
-	thumb := imaging.Fill(src, 512, 512, imaging.Center, imaging.Lanczos)
+// loadImage decodes the original upright, applying the EXIF orientation,
+// and reads its metadata.
+func (p *ImageProcessor) loadImage(job ImageJob) (image.Image, *models.ImageMetadata, error) {
+	obj, err := p.store.Get(context.Background(), job.StorageKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open image: %w", err)
+	}
+	defer obj.Close()
 
-	thumbPath := filepath.Join(p.thumbDir, fmt.Sprintf("thumb_%d.jpg", job.FileID))
-	if err := imaging.Save(thumb, thumbPath, imaging.JPEGQuality(80)); err != nil {
-		return "", fmt.Errorf("save thumbnail: %w", err)
+	src, err := DecodeImage(obj, p.cfg.MaxPixels)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return thumbPath, nil
+	if _, err := obj.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, fmt.Errorf("rewind image: %w", err)
+	}
+	return src, ExtractMetadata(obj, src), nil
 }
 
 func (p *ImageProcessor) updateStatus(id int64, status string) {
@@ -126,18 +414,19 @@ func (p *ImageProcessor) updateStatus(id int64, status string) {
 		log.Printf("Failed to update status for image %d: %v", id, err)
 	}
 }
-func (p *ImageProcessor) Queue(job ImageJob) {
+
+// Wake nudges an idle worker to look for new jobs right away instead of
+// waiting for the next poll. Jobs themselves live in image_jobs.
+func (p *ImageProcessor) Wake() {
 	select {
-	case p.jobs <- job:
+	case p.wake <- struct{}{}:
 	default:
-		log.Printf("Warning: job queue full, skipping image %d", job.FileID)
 	}
 }
 
 func (p *ImageProcessor) Shutdown() {
 	p.once.Do(func() {
-		close(p.jobs)
+		close(p.done)
 		p.wg.Wait()
-		p.embedder.Close()
 	})
 }
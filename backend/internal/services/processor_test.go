@@ -0,0 +1,384 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"imageapp/internal/models"
+	"imageapp/internal/services"
+	"imageapp/internal/storage"
+	"imageapp/internal/testdb"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	pgvector "github.com/pgvector/pgvector-go"
+)
+
+// countingEmbedder records the batches it was asked to embed.
+type countingEmbedder struct {
+	*services.FakeEmbedder
+	mu      sync.Mutex
+	batches []int
+}
+
+func (e *countingEmbedder) EmbedBatch(texts []string) ([][]float32, error) {
+	e.mu.Lock()
+	e.batches = append(e.batches, len(texts))
+	e.mu.Unlock()
+	return e.FakeEmbedder.EmbedBatch(texts)
+}
+
+// fakeVisual embeds every image to the same vector.
+type fakeVisual struct{}
+
+func (fakeVisual) EmbedImage(image.Image) ([]float32, error) {
+	v := make([]float32, services.ClipDim)
+	v[0] = 1
+	return v, nil
+}
+
+func (fakeVisual) EmbedText(string) ([]float32, error) {
+	return fakeVisual{}.EmbedImage(nil)
+}
+
+// deletingVisual deletes every image while embedding it, after its
+// renditions were stored.
+type deletingVisual struct {
+	fakeVisual
+	db *pgxpool.Pool
+}
+
+func (v deletingVisual) EmbedImage(img image.Image) ([]float32, error) {
+	if _, err := v.db.Exec(context.Background(), "DELETE FROM images"); err != nil {
+		return nil, err
+	}
+	return v.fakeVisual.EmbedImage(img)
+}
+
+// fakeTagger suggests "sky" unless the image already has it or it was
+// rejected.
+type fakeTagger struct{}
+
+func (fakeTagger) Suggest(_ []float32, tags, rejected []string) []models.SuggestedTag {
+	if services.ContainsTag(tags, "sky") || services.ContainsTag(rejected, "sky") {
+		return []models.SuggestedTag{}
+	}
+	return []models.SuggestedTag{{Tag: "sky", Confidence: 0.9}}
+}
+
+func testPNG(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	img.Set(0, 0, color.White)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// insertImage stores data and adds a queued image row for it.
+func insertImage(t *testing.T, db *pgxpool.Pool, store storage.Storage, title string, tags []string, data []byte) int64 {
+	t.Helper()
+	ctx := context.Background()
+	key := fmt.Sprintf("originals/%s.png", title)
+	if err := store.Put(ctx, key, bytes.NewReader(data), int64(len(data)), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	var id int64
+	err := db.QueryRow(ctx, `
+		INSERT INTO images (title, tags, filename, size, mime, checksum, storage_path, image_url)
+		VALUES ($1, $2, $3, $4, 'image/png', $1, $5, $6)
+		RETURNING id
+	`, title, tags, title+".png", len(data), key, store.URL(key)).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := services.EnqueueImageJob(ctx, db, id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// waitProcessed waits until the image is no longer pending or processing
+// and returns its status.
+func waitProcessed(t *testing.T, db *pgxpool.Pool, id int64) string {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		var status string
+		err := db.QueryRow(context.Background(), `
+			SELECT i.thumbnail_status FROM images i
+			WHERE i.id = $1 AND NOT EXISTS (
+				SELECT 1 FROM image_jobs j WHERE j.image_id = i.id AND j.status = 'processing'
+			)
+		`, id).Scan(&status)
+		if err == nil && status != "pending" && status != "processing" {
+			return status
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("image %d was not processed in time", id)
+	return ""
+}
+
+func newTestProcessor(t *testing.T, db *pgxpool.Pool, store storage.Storage, textModels services.TextModels) *services.ImageProcessor {
+	p := services.NewImageProcessor(db, store, services.ProcessorConfig{
+		Workers:      1,
+		PollInterval: 20 * time.Millisecond,
+		Renditions:   services.DefaultRenditions,
+		BatchSize:    8,
+	}, textModels, fakeVisual{}, fakeTagger{}, nil)
+	t.Cleanup(p.Shutdown)
+	return p
+}
+
+func TestProcessorBatch(t *testing.T) {
+	db := testdb.New(t)
+	store, err := storage.NewLocal(t.TempDir(), "/storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedder := &countingEmbedder{FakeEmbedder: services.NewFakeEmbedder(services.EmbeddingDim)}
+	textModels := testdb.Models(t, db, embedder)
+
+	data := testPNG(t)
+	tags := map[int64][]string{}
+	for i, title := range []string{"beach", "forest", "city"} {
+		id := insertImage(t, db, store, title, []string{title, fmt.Sprint("tag", i)}, data)
+		tags[id] = []string{title, fmt.Sprint("tag", i)}
+	}
+
+	newTestProcessor(t, db, store, textModels)
+
+	for id, want := range tags {
+		if status := waitProcessed(t, db, id); status != "ready" {
+			t.Fatalf("image %d: status %q, want ready", id, status)
+		}
+
+		var thumb string
+		var embedding, imageEmbedding pgvector.Vector
+		var suggested []models.SuggestedTag
+		err := db.QueryRow(context.Background(), `
+			SELECT thumbnail_path, embedding, image_embedding, suggested_tags
+			FROM images WHERE id = $1
+		`, id).Scan(&thumb, &embedding, &imageEmbedding, &suggested)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if thumb != services.RenditionKey(id, "sq512") {
+			t.Errorf("image %d: thumbnail %q", id, thumb)
+		}
+		if _, err := store.Stat(context.Background(), thumb); err != nil {
+			t.Errorf("image %d: thumbnail not stored: %v", id, err)
+		}
+		wantVec, _ := services.NewFakeEmbedder(services.EmbeddingDim).EmbedTags(want...)
+		if !slicesAlmostEqual(embedding.Slice(), wantVec) {
+			t.Errorf("image %d: embedding is not the one of %v", id, want)
+		}
+		if imageEmbedding.Slice()[0] != 1 {
+			t.Errorf("image %d: image embedding not stored", id)
+		}
+		if len(suggested) != 1 || suggested[0].Tag != "sky" {
+			t.Errorf("image %d: suggested %v, want sky", id, suggested)
+		}
+	}
+
+	embedder.mu.Lock()
+	defer embedder.mu.Unlock()
+	if len(embedder.batches) != 1 || embedder.batches[0] != len(tags) {
+		t.Errorf("embedded in batches %v, want one batch of %d", embedder.batches, len(tags))
+	}
+}
+
+// slowVisual takes delay per image and counts the images it embedded.
+type slowVisual struct {
+	fakeVisual
+	delay time.Duration
+	calls atomic.Int64
+}
+
+func (v *slowVisual) EmbedImage(img image.Image) ([]float32, error) {
+	v.calls.Add(1)
+	time.Sleep(v.delay)
+	return v.fakeVisual.EmbedImage(img)
+}
+
+func TestProcessorRenewsLease(t *testing.T) {
+	db := testdb.New(t)
+	store, err := storage.NewLocal(t.TempDir(), "/storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedder := &countingEmbedder{FakeEmbedder: services.NewFakeEmbedder(services.EmbeddingDim)}
+	textModels := testdb.Models(t, db, embedder)
+
+	var ids []int64
+	for _, title := range []string{"one", "two", "three"} {
+		ids = append(ids, insertImage(t, db, store, title, []string{title}, testPNG(t)))
+	}
+
+	// the batch takes longer than one lease; a second worker would take
+	// over jobs whose lease was not renewed
+	visual := &slowVisual{delay: 250 * time.Millisecond}
+	p := services.NewImageProcessor(db, store, services.ProcessorConfig{
+		Workers:      2,
+		PollInterval: 20 * time.Millisecond,
+		Lease:        500 * time.Millisecond,
+		Renditions:   services.DefaultRenditions,
+	}, textModels, visual, fakeTagger{}, nil)
+	t.Cleanup(p.Shutdown)
+
+	for _, id := range ids {
+		if status := waitProcessed(t, db, id); status != "ready" {
+			t.Fatalf("image %d: status %q, want ready", id, status)
+		}
+	}
+	if n := visual.calls.Load(); n != int64(len(ids)) {
+		t.Errorf("%d images processed for %d jobs", n, len(ids))
+	}
+	embedder.mu.Lock()
+	defer embedder.mu.Unlock()
+	if len(embedder.batches) != 1 || embedder.batches[0] != len(ids) {
+		t.Errorf("embedded in batches %v, want one batch of %d", embedder.batches, len(ids))
+	}
+}
+
+func TestProcessorBatchWindow(t *testing.T) {
+	db := testdb.New(t)
+	store, err := storage.NewLocal(t.TempDir(), "/storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedder := &countingEmbedder{FakeEmbedder: services.NewFakeEmbedder(services.EmbeddingDim)}
+	textModels := testdb.Models(t, db, embedder)
+
+	first := insertImage(t, db, store, "first", []string{"first"}, testPNG(t))
+	p := services.NewImageProcessor(db, store, services.ProcessorConfig{
+		Workers:      1,
+		PollInterval: time.Hour,
+		Renditions:   services.DefaultRenditions,
+		BatchWindow:  time.Second,
+	}, textModels, fakeVisual{}, fakeTagger{}, nil)
+	t.Cleanup(p.Shutdown)
+
+	// uploaded while the worker waits for more jobs
+	time.Sleep(100 * time.Millisecond)
+	second := insertImage(t, db, store, "second", []string{"second"}, testPNG(t))
+	p.Wake()
+
+	for _, id := range []int64{first, second} {
+		if status := waitProcessed(t, db, id); status != "ready" {
+			t.Fatalf("image %d: status %q, want ready", id, status)
+		}
+	}
+	embedder.mu.Lock()
+	defer embedder.mu.Unlock()
+	if len(embedder.batches) != 1 || embedder.batches[0] != 2 {
+		t.Errorf("embedded in batches %v, want one batch of 2", embedder.batches)
+	}
+}
+
+func TestProcessorInvalidImage(t *testing.T) {
+	db := testdb.New(t)
+	store, err := storage.NewLocal(t.TempDir(), "/storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	textModels := testdb.Models(t, db, services.NewFakeEmbedder(services.EmbeddingDim))
+
+	bad := insertImage(t, db, store, "broken", []string{"broken"}, []byte("not an image"))
+	good := insertImage(t, db, store, "fine", []string{"fine"}, testPNG(t))
+
+	newTestProcessor(t, db, store, textModels)
+
+	// an invalid image is not retried, and does not fail the rest of its batch
+	if status := waitProcessed(t, db, bad); status != "failed" {
+		t.Errorf("invalid image: status %q, want failed", status)
+	}
+	if status := waitProcessed(t, db, good); status != "ready" {
+		t.Errorf("valid image: status %q, want ready", status)
+	}
+	var jobStatus string
+	err = db.QueryRow(context.Background(), `
+		SELECT status FROM image_jobs WHERE image_id = $1
+	`, bad).Scan(&jobStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobStatus != "dead" {
+		t.Errorf("job status %q, want dead", jobStatus)
+	}
+}
+
+func TestProcessorImageDeleted(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.New(t)
+	store, err := storage.NewLocal(t.TempDir(), "/storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	textModels := testdb.Models(t, db, services.NewFakeEmbedder(services.EmbeddingDim))
+	id := insertImage(t, db, store, "gone", []string{"gone"}, testPNG(t))
+
+	p := services.NewImageProcessor(db, store, services.ProcessorConfig{
+		Workers:      1,
+		PollInterval: 20 * time.Millisecond,
+		Renditions:   services.DefaultRenditions,
+	}, textModels, deletingVisual{db: db}, fakeTagger{}, func(job services.ImageJob) {
+		t.Errorf("completion reported for deleted image %d", job.FileID)
+	})
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		var n int
+		if err := db.QueryRow(ctx, "SELECT count(*) FROM images").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("image was not processed in time")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// waits for the batch the image was deleted in
+	p.Shutdown()
+
+	for _, r := range services.DefaultRenditions {
+		key := services.RenditionKey(id, r.Name)
+		if _, err := store.Stat(ctx, key); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("rendition %s left behind: %v", key, err)
+		}
+	}
+	var rows int
+	if err := db.QueryRow(ctx, "SELECT count(*) FROM image_renditions").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Errorf("%d rendition rows left behind", rows)
+	}
+}
+
+func slicesAlmostEqual(a, b []float32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if d := a[i] - b[i]; d > 1e-6 || d < -1e-6 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// QueryCache keeps the embeddings of recent search queries, so paging
+// through results or repeating a search skips inference. Entries are keyed
+// by model and normalized text and the least recently used one is evicted
+// once size is reached. Concurrent misses for the same key share one
+// inference.
+type QueryCache struct {
+	size  int
+	mu    sync.Mutex
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+	group singleflight.Group
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type queryCacheEntry struct {
+	key    string
+	vector []float32
+}
+
+// QueryCacheStats is a snapshot of the cache counters.
+type QueryCacheStats struct {
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	Entries  int    `json:"entries"`
+	Capacity int    `json:"capacity"`
+}
+
+func NewQueryCache(size int) *QueryCache {
+	return &QueryCache{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Embed returns the cached vector of query for model, or computes it with
+// embed. Callers must not modify the returned slice.
+func (c *QueryCache) Embed(model, query string, embed func(string) ([]float32, error)) ([]float32, error) {
+	text := normalizeQuery(query)
+	key := model + "\x00" + text
+
+	if vec, ok := c.get(key); ok {
+		c.hits.Add(1)
+		return vec, nil
+	}
+	c.misses.Add(1)
+
+	v, err, _ := c.group.Do(key, func() (any, error) {
+		vec, err := embed(text)
+		if err != nil {
+			return nil, err
+		}
+		c.put(key, vec)
+		return vec, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]float32), nil
+}
+
+func (c *QueryCache) get(key string) ([]float32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*queryCacheEntry).vector, true
+}
+
+func (c *QueryCache) put(key string, vec []float32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*queryCacheEntry).vector = vec
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&queryCacheEntry{key: key, vector: vec})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*queryCacheEntry).key)
+	}
+}
+
+func (c *QueryCache) Stats() QueryCacheStats {
+	c.mu.Lock()
+	entries := c.order.Len()
+	c.mu.Unlock()
+	return QueryCacheStats{
+		Hits:     c.hits.Load(),
+		Misses:   c.misses.Load(),
+		Entries:  entries,
+		Capacity: c.size,
+	}
+}
+
+// normalizeQuery lowercases query and collapses whitespace, so "Beach  "
+// and "beach" share an entry. The bundled models are uncased.
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(strings.ToLower(query)), " ")
+}
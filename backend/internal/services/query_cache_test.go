@@ -0,0 +1,128 @@
+package services_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"imageapp/internal/services"
+)
+
+// countedEmbed wraps the fake embedder's EmbedTags and counts its calls.
+type countedEmbed struct {
+	e       *services.FakeEmbedder
+	calls   atomic.Int64
+	release chan struct{} // if set, every call waits for it to be closed
+}
+
+func (c *countedEmbed) embed(text string) ([]float32, error) {
+	c.calls.Add(1)
+	if c.release != nil {
+		<-c.release
+	}
+	return c.e.EmbedTags(text)
+}
+
+func TestQueryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := services.NewQueryCache(2)
+	ce := &countedEmbed{e: services.NewFakeEmbedder(8)}
+
+	for _, q := range []string{"beach", "forest", "beach", "city"} {
+		if _, err := c.Embed("m", q, ce.embed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// forest was the least recently used when city came in
+	if n := ce.calls.Load(); n != 3 {
+		t.Fatalf("%d inferences, want 3", n)
+	}
+	c.Embed("m", "beach", ce.embed)
+	c.Embed("m", "city", ce.embed)
+	if n := ce.calls.Load(); n != 3 {
+		t.Errorf("beach or city was evicted")
+	}
+	c.Embed("m", "forest", ce.embed)
+	if n := ce.calls.Load(); n != 4 {
+		t.Errorf("forest was still cached")
+	}
+
+	stats := c.Stats()
+	if stats.Entries != 2 || stats.Capacity != 2 {
+		t.Errorf("%d entries of %d, want 2 of 2", stats.Entries, stats.Capacity)
+	}
+	if stats.Hits+stats.Misses != 7 || stats.Misses != uint64(ce.calls.Load()) {
+		t.Errorf("%d hits and %d misses for 7 lookups and %d inferences", stats.Hits, stats.Misses, ce.calls.Load())
+	}
+}
+
+func TestQueryCacheKeysByModel(t *testing.T) {
+	c := services.NewQueryCache(8)
+	small := &countedEmbed{e: services.NewFakeEmbedder(8)}
+	large := &countedEmbed{e: services.NewFakeEmbedder(16)}
+
+	a, err := c.Embed("small", "Beach  sunset", small.embed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.Embed("large", "beach sunset", large.embed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 8 || len(b) != 16 || small.calls.Load() != 1 || large.calls.Load() != 1 {
+		t.Errorf("one model's vector served for the other")
+	}
+
+	// normalized text shares the entry
+	if _, err := c.Embed("small", " BEACH sunset", small.embed); err != nil {
+		t.Fatal(err)
+	}
+	if small.calls.Load() != 1 {
+		t.Errorf("differently spaced query embedded again")
+	}
+	if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("%d hits and %d misses, want 1 and 2", stats.Hits, stats.Misses)
+	}
+}
+
+func TestQueryCacheCollapsesConcurrentMisses(t *testing.T) {
+	const callers = 8
+	c := services.NewQueryCache(8)
+	ce := &countedEmbed{e: services.NewFakeEmbedder(8), release: make(chan struct{})}
+
+	var wg sync.WaitGroup
+	vectors := make([][]float32, callers)
+	for i := range callers {
+		wg.Go(func() {
+			vec, err := c.Embed("m", "beach", ce.embed)
+			if err != nil {
+				t.Error(err)
+			}
+			vectors[i] = vec
+		})
+	}
+
+	// every caller has missed before the inference finishes
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().Misses < callers {
+		if time.Now().After(deadline) {
+			t.Fatal("callers did not miss")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(ce.release)
+	wg.Wait()
+
+	if n := ce.calls.Load(); n != 1 {
+		t.Errorf("%d inferences for %d concurrent misses, want 1", n, callers)
+	}
+	for i := range vectors {
+		if !slicesAlmostEqual(vectors[i], vectors[0]) {
+			t.Errorf("caller %d got another vector", i)
+		}
+	}
+	if stats := c.Stats(); stats.Hits+stats.Misses != callers || stats.Entries != 1 {
+		t.Errorf("%d hits, %d misses, %d entries for %d calls", stats.Hits, stats.Misses, stats.Entries, callers)
+	}
+}
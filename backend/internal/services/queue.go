@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// errLeaseLost means the job's lease ran out and another worker claimed
+// it, so this worker's result was not recorded.
+var errLeaseLost = errors.New("lease lost to another worker")
+
+// Execer is implemented by *pgxpool.Pool and pgx.Tx, so a job can be
+// enqueued inside the same transaction that inserts the image row.
+type Execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// EnqueueImageJob adds a processing job for the given image to the
+// image_jobs table. An existing job for the same image is reset to queued
+// with a fresh attempt counter.
+func EnqueueImageJob(ctx context.Context, db Execer, imageID int64) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO image_jobs (image_id, status, run_at)
+		VALUES ($1, 'queued', NOW())
+		ON CONFLICT (image_id) DO UPDATE
+		SET status = 'queued',
+		    run_at = NOW(),
+		    attempts = 0,
+		    last_error = NULL,
+		    locked_by = NULL,
+		    lease_until = NULL,
+		    updated_at = NOW()
+	`, imageID)
+	if err != nil {
+		return fmt.Errorf("enqueue image %d: %w", imageID, err)
+	}
+	return nil
+}
+
+// claimJobs picks up to n of the oldest runnable jobs, leases them to
+// workerID and counts the attempt. Jobs stuck in 'processing' whose lease
+// ran out are picked up again, so a crashed instance never strands work.
+func (p *ImageProcessor) claimJobs(ctx context.Context, workerID string, n int) ([]ImageJob, error) {
+	rows, err := p.db.Query(ctx, `
+		WITH next AS (
+			SELECT id
+			FROM image_jobs
+			WHERE (status = 'queued' AND run_at <= NOW())
+			   OR (status = 'processing' AND lease_until < NOW())
+			ORDER BY run_at, id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		), claimed AS (
+			UPDATE image_jobs j
+			SET status = 'processing',
+			    attempts = j.attempts + 1,
+			    locked_by = $1,
+			    lease_until = NOW() + make_interval(secs => $2),
+			    updated_at = NOW()
+			FROM next
+			WHERE j.id = next.id
+			RETURNING j.image_id, j.attempts, j.run_at, j.id
+		)
+		SELECT i.id, i.storage_path, i.filename, i.title, i.tags, c.attempts
+		FROM claimed c
+		JOIN images i ON i.id = c.image_id
+		ORDER BY c.run_at, c.id
+	`, workerID, p.cfg.Lease.Seconds(), n)
+	if err != nil {
+		return nil, fmt.Errorf("claim jobs: %w", err)
+	}
+	jobs, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ImageJob, error) {
+		var job ImageJob
+		err := row.Scan(&job.FileID, &job.StorageKey, &job.Filename, &job.Title, &job.Tags, &job.Attempts)
+		return job, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("claim jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// claimBatch claims the queued jobs, up to BatchSize, and keeps adding
+// jobs that are enqueued on this instance within BatchWindow, so uploads
+// arriving together are embedded together.
+func (p *ImageProcessor) claimBatch(ctx context.Context, workerID string) ([]ImageJob, error) {
+	jobs, err := p.claimJobs(ctx, workerID, p.cfg.BatchSize)
+	if err != nil || len(jobs) == 0 || p.cfg.BatchWindow == 0 {
+		return jobs, err
+	}
+
+	timer := time.NewTimer(p.cfg.BatchWindow)
+	defer timer.Stop()
+	for len(jobs) < p.cfg.BatchSize {
+		select {
+		case <-p.done:
+			return jobs, nil
+		case <-timer.C:
+			return jobs, nil
+		case <-p.wake:
+		}
+		more, err := p.claimJobs(ctx, workerID, p.cfg.BatchSize-len(jobs))
+		if err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, more...)
+	}
+	return jobs, nil
+}
+
+// extendLease renews the lease of jobs still held by workerID and returns
+// the ids of those, a job missing from it was taken over by another
+// worker.
+func (p *ImageProcessor) extendLease(ctx context.Context, workerID string, jobs []ImageJob) (map[int64]bool, error) {
+	held := make(map[int64]bool, len(jobs))
+	if len(jobs) == 0 {
+		return held, nil
+	}
+	ids := make([]int64, len(jobs))
+	for i, job := range jobs {
+		ids[i] = job.FileID
+	}
+	rows, err := p.db.Query(ctx, `
+		UPDATE image_jobs
+		SET lease_until = NOW() + make_interval(secs => $3),
+		    updated_at = NOW()
+		WHERE image_id = ANY($1) AND locked_by = $2 AND status = 'processing'
+		RETURNING image_id
+	`, ids, workerID, p.cfg.Lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("extend lease: %w", err)
+	}
+	kept, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, fmt.Errorf("extend lease: %w", err)
+	}
+	for _, id := range kept {
+		held[id] = true
+	}
+	return held, nil
+}
+
+// completeJob removes the job once the image is fully processed.
+func (p *ImageProcessor) completeJob(ctx context.Context, imageID int64, workerID string) error {
+	tag, err := p.db.Exec(ctx, `
+		DELETE FROM image_jobs
+		WHERE image_id = $1 AND locked_by = $2
+	`, imageID, workerID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errLeaseLost
+	}
+	return nil
+}
+
+// failJob records the error and either schedules another attempt with
+// exponential backoff or, once MaxAttempts is used up or the image itself
+// is invalid, moves the job to the terminal 'dead' state. It reports
+// whether the job is dead.
+func (p *ImageProcessor) failJob(ctx context.Context, job ImageJob, workerID string, jobErr error) (bool, error) {
+	dead := job.Attempts >= p.cfg.MaxAttempts || errors.Is(jobErr, ErrInvalidImage)
+	status := "queued"
+	if dead {
+		status = "dead"
+	}
+
+	tag, err := p.db.Exec(ctx, `
+		UPDATE image_jobs
+		SET status = $1,
+		    last_error = $2,
+		    run_at = NOW() + make_interval(secs => $3),
+		    locked_by = NULL,
+		    lease_until = NULL,
+		    updated_at = NOW()
+		WHERE image_id = $4 AND locked_by = $5
+	`, status, jobErr.Error(), p.backoff(job.Attempts).Seconds(), job.FileID, workerID)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, errLeaseLost
+	}
+	return dead, nil
+}
+
+// backoff returns the delay before the next attempt: BackoffBase doubled
+// for every attempt already made, capped at BackoffMax.
+func (p *ImageProcessor) backoff(attempts int) time.Duration {
+	d := p.cfg.BackoffBase
+	for i := 1; i < attempts && d < p.cfg.BackoffMax; i++ {
+		d *= 2
+	}
+	return min(d, p.cfg.BackoffMax)
+}
@@ -0,0 +1,269 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"imageapp/internal/services"
+	"imageapp/internal/testdb"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// insertQueued adds n image rows with a queued job each.
+func insertQueued(t *testing.T, db *pgxpool.Pool, n int) []int64 {
+	t.Helper()
+	ctx := context.Background()
+	var ids []int64
+	for i := range n {
+		var id int64
+		err := db.QueryRow(ctx, `
+			INSERT INTO images (title, tags, filename, size, mime, checksum, storage_path, image_url)
+			VALUES ($1, '{}', 'q.png', 1, 'image/png', $1, 'originals/q.png', '/uploads/q.png')
+			RETURNING id
+		`, fmt.Sprint("queued", i)).Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := services.EnqueueImageJob(ctx, db, id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// jobState reads the queue columns of the job for imageID.
+func jobState(t *testing.T, db *pgxpool.Pool, imageID int64) (status, lockedBy string, attempts int) {
+	t.Helper()
+	err := db.QueryRow(context.Background(), `
+		SELECT status, COALESCE(locked_by, ''), attempts FROM image_jobs WHERE image_id = $1
+	`, imageID).Scan(&status, &lockedBy, &attempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, lockedBy, attempts
+}
+
+func TestClaimJobsConcurrently(t *testing.T) {
+	db := testdb.New(t)
+	ids := insertQueued(t, db, 40)
+	q := services.NewTestQueue(db, services.ProcessorConfig{})
+
+	var mu sync.Mutex
+	claimed := map[int64]int{}
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				jobs, err := services.ClaimJobs(q, context.Background(), fmt.Sprint("worker", w), 3)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(jobs) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, job := range jobs {
+					claimed[job.FileID]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(claimed) != len(ids) {
+		t.Errorf("claimed %d jobs, want %d", len(claimed), len(ids))
+	}
+	for id, n := range claimed {
+		if n != 1 {
+			t.Errorf("job %d claimed %d times", id, n)
+		}
+	}
+}
+
+func TestClaimJobsReclaimsExpiredLease(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.New(t)
+	id := insertQueued(t, db, 1)[0]
+	q := services.NewTestQueue(db, services.ProcessorConfig{Lease: 200 * time.Millisecond})
+
+	jobs, err := services.ClaimJobs(q, ctx, "a", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].FileID != id || jobs[0].Attempts != 1 {
+		t.Fatalf("first claim: %+v", jobs)
+	}
+
+	// leased to a, nothing for b
+	jobs, err = services.ClaimJobs(q, ctx, "b", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("claimed a leased job: %+v", jobs)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	jobs, err = services.ClaimJobs(q, ctx, "b", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Attempts != 2 {
+		t.Fatalf("reclaim after the lease ran out: %+v", jobs)
+	}
+
+	// a finishes late, neither outcome may overwrite b's lease
+	if err := services.CompleteJob(q, ctx, id, "a"); !errors.Is(err, services.ErrLeaseLost) {
+		t.Errorf("complete by stale worker: %v, want lease lost", err)
+	}
+	if _, err := services.FailJob(q, ctx, jobs[0], "a", errors.New("boom")); !errors.Is(err, services.ErrLeaseLost) {
+		t.Errorf("fail by stale worker: %v, want lease lost", err)
+	}
+	if status, lockedBy, attempts := jobState(t, db, id); status != "processing" || lockedBy != "b" || attempts != 2 {
+		t.Errorf("job after stale updates: %s, locked by %q, %d attempts", status, lockedBy, attempts)
+	}
+
+	if err := services.CompleteJob(q, ctx, id, "b"); err != nil {
+		t.Fatalf("complete by lease holder: %v", err)
+	}
+	var n int
+	if err := db.QueryRow(ctx, "SELECT count(*) FROM image_jobs").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d jobs left after completion", n)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	q := services.NewTestQueue(nil, services.ProcessorConfig{
+		BackoffBase: 10 * time.Second,
+		BackoffMax:  time.Minute,
+	})
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, time.Minute},
+		{30, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := services.Backoff(q, tt.attempts); got != tt.want {
+			t.Errorf("attempt %d: backoff %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+
+	q = services.NewTestQueue(nil, services.ProcessorConfig{BackoffBase: time.Hour, BackoffMax: time.Minute})
+	if got := services.Backoff(q, 1); got != time.Minute {
+		t.Errorf("base above max: backoff %v, want %v", got, time.Minute)
+	}
+}
+
+func TestFailJobRetriesThenDies(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.New(t)
+	ids := insertQueued(t, db, 2)
+	q := services.NewTestQueue(db, services.ProcessorConfig{MaxAttempts: 2, BackoffBase: time.Hour})
+
+	lastError := func(id int64) (string, time.Duration) {
+		var msg string
+		var wait float64
+		err := db.QueryRow(ctx, `
+			SELECT last_error, EXTRACT(EPOCH FROM run_at - NOW())::float8 FROM image_jobs WHERE image_id = $1
+		`, id).Scan(&msg, &wait)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg, time.Duration(wait * float64(time.Second))
+	}
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		jobs, err := services.ClaimJobs(q, ctx, "w", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) != 1 || jobs[0].FileID != ids[0] || jobs[0].Attempts != attempt {
+			t.Fatalf("attempt %d: claimed %+v", attempt, jobs)
+		}
+		dead, err := services.FailJob(q, ctx, jobs[0], "w", fmt.Errorf("boom %d", attempt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, _, _ := jobState(t, db, ids[0])
+		msg, wait := lastError(ids[0])
+		if msg != fmt.Sprint("boom ", attempt) {
+			t.Errorf("attempt %d: last_error %q", attempt, msg)
+		}
+
+		if attempt == 1 {
+			if dead || status != "queued" {
+				t.Errorf("attempt 1: dead %v, status %s, want a retry", dead, status)
+			}
+			if wait < 59*time.Minute {
+				t.Errorf("attempt 1: retried in %v, want the backoff of an hour", wait)
+			}
+			// not claimable before run_at; skip the wait
+			if _, err := db.Exec(ctx, "UPDATE image_jobs SET run_at = NOW() WHERE image_id = $1", ids[0]); err != nil {
+				t.Fatal(err)
+			}
+		} else if !dead || status != "dead" {
+			t.Errorf("attempt 2: dead %v, status %s, want dead after MaxAttempts", dead, status)
+		}
+	}
+
+	// an invalid image is not retried at all
+	jobs, err := services.ClaimJobs(q, ctx, "w", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].FileID != ids[1] {
+		t.Fatalf("claimed %+v", jobs)
+	}
+	dead, err := services.FailJob(q, ctx, jobs[0], "w", fmt.Errorf("decode: %w", services.ErrInvalidImage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := jobState(t, db, ids[1]); !dead || status != "dead" {
+		t.Errorf("invalid image: dead %v, status %s", dead, status)
+	}
+}
+
+func TestMigrateMarksFailedJobsDeadOnce(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.New(t)
+	id := insertQueued(t, db, 1)[0]
+	if _, err := db.Exec(ctx, "UPDATE image_jobs SET status = 'failed' WHERE image_id = $1", id); err != nil {
+		t.Fatal(err)
+	}
+
+	// already applied when the schema was created
+	if err := services.Migrate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := jobState(t, db, id); status != "failed" {
+		t.Errorf("status %s after a second migration, want it left alone", status)
+	}
+
+	if _, err := db.Exec(ctx, "DELETE FROM schema_migrations WHERE name = 'image_jobs_failed_to_dead'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := services.Migrate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := jobState(t, db, id); status != "dead" {
+		t.Errorf("status %s, want dead", status)
+	}
+}
@@ -0,0 +1,216 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	pgvector "github.com/pgvector/pgvector-go"
+)
+
+// errReembedBusy means another instance holds the re-embed lock or has
+// already switched models.
+var errReembedBusy = errors.New("another instance is re-embedding")
+
+// Reembedder backfills the next model's vectors for all processed images in
+// the background, batch by batch, and switches the set over once coverage
+// is complete. It does nothing if no migration is configured. With several
+// instances, one of them does the work at a time.
+type Reembedder struct {
+	db        DB
+	models    *ModelSet
+	batchSize int
+	interval  time.Duration // pause between coverage checks once caught up
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+func NewReembedder(db DB, models *ModelSet, batchSize int) *Reembedder {
+	if batchSize <= 0 {
+		batchSize = 64
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Reembedder{
+		db:        db,
+		models:    models,
+		batchSize: batchSize,
+		interval:  10 * time.Second,
+		cancel:    cancel,
+	}
+
+	r.wg.Add(1)
+	go r.run(ctx)
+	return r
+}
+
+func (r *Reembedder) run(ctx context.Context) {
+	defer r.wg.Done()
+
+	for {
+		// another instance may have switched already
+		if err := r.models.refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Re-embed: %v", err)
+		}
+		next := r.models.Next()
+		if next == nil {
+			return
+		}
+
+		var n int
+		staged, err := r.models.stageColumn(ctx)
+		if err == nil {
+			n, err = r.embedBatch(ctx, *next, staged)
+		}
+		if err == nil && n == 0 {
+			var switched bool
+			switched, err = r.models.switchToNext(ctx)
+			if switched {
+				return
+			}
+		}
+		if err != nil && ctx.Err() == nil && !errors.Is(err, errReembedBusy) {
+			log.Printf("Re-embed %s: %v", next.Name, err)
+		}
+
+		if n == 0 || err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(r.interval):
+			}
+		}
+	}
+}
+
+// embedBatch embeds the next batch of images that have no vector for m
+// yet, or one computed from an older title or tags, and returns how many
+// it found. The batch is read and written in two short transactions under
+// the re-embed lock; the inference runs between them, holding neither.
+// With staged, the vectors also go to images.embedding_next.
+func (r *Reembedder) embedBatch(ctx context.Context, m EmbeddingModel, staged bool) (int, error) {
+	ids, titles, tags, err := r.nextBatch(ctx, m)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	vectors, err := r.models.Composer().EmbedBatch(m.Embedder, titles, tags)
+	if err != nil {
+		return 0, fmt.Errorf("embed: %w", err)
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	locked, err := tryReembedLock(ctx, tx, m.Name)
+	if err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, errReembedBusy
+	}
+
+	for i, id := range ids {
+		// skipped if the image was edited meanwhile, the next round
+		// picks it up again
+		_, err := tx.Exec(ctx, `
+			INSERT INTO image_embeddings (image_id, model, embedding, title, tags)
+			SELECT id, $2, $3, title, tags FROM images
+			WHERE id = $1 AND title = $4 AND tags = $5
+			ON CONFLICT (image_id, model) DO UPDATE
+			SET embedding = EXCLUDED.embedding, title = EXCLUDED.title, tags = EXCLUDED.tags
+		`, id, m.Name, pgvector.NewVector(vectors[i]), titles[i], tags[i])
+		if err != nil {
+			return 0, fmt.Errorf("store embedding for image %d: %w", id, err)
+		}
+		if !staged {
+			continue
+		}
+		_, err = tx.Exec(ctx, `
+			UPDATE images SET embedding_next = $2
+			WHERE id = $1 AND title = $3 AND tags = $4
+		`, id, pgvector.NewVector(vectors[i]), titles[i], tags[i])
+		if err != nil {
+			return 0, fmt.Errorf("stage embedding for image %d: %w", id, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+
+	var done, total int64
+	err = r.db.QueryRow(ctx, `
+		SELECT
+			(SELECT count(*) FROM image_embeddings e JOIN images i ON i.id = e.image_id
+			 WHERE e.model = $1 AND e.title = i.title AND e.tags = i.tags
+			   AND i.embedding_model IS NOT NULL),
+			(SELECT count(*) FROM images WHERE embedding_model IS NOT NULL)
+	`, m.Name).Scan(&done, &total)
+	if err == nil {
+		log.Printf("Re-embed %s: %d/%d images", m.Name, done, total)
+	}
+	return len(ids), nil
+}
+
+// nextBatch reads the images embedBatch works on. Taking the re-embed lock
+// here as well lets other instances back off without embedding the same
+// batch.
+func (r *Reembedder) nextBatch(ctx context.Context, m EmbeddingModel) (ids []int64, titles []string, tags [][]string, err error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	locked, err := tryReembedLock(ctx, tx, m.Name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !locked {
+		return nil, nil, nil, errReembedBusy
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, title, tags FROM images i
+		WHERE i.embedding_model IS NOT NULL
+		  AND NOT EXISTS (
+			SELECT 1 FROM image_embeddings e
+			WHERE e.image_id = i.id AND e.model = $1
+			  AND e.title = i.title AND e.tags = i.tags
+		  )
+		ORDER BY id
+		LIMIT $2
+	`, m.Name, r.batchSize)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var title string
+		var t []string
+		if err := rows.Scan(&id, &title, &t); err != nil {
+			return nil, nil, nil, fmt.Errorf("scan: %w", err)
+		}
+		ids = append(ids, id)
+		titles = append(titles, title)
+		tags = append(tags, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, fmt.Errorf("query: %w", err)
+	}
+	return ids, titles, tags, nil
+}
+
+// Shutdown stops the backfill and waits for the current batch.
+func (r *Reembedder) Shutdown() {
+	r.cancel()
+	r.wg.Wait()
+}
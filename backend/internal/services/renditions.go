@@ -0,0 +1,120 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Rendition describes one derived size of an image. "fill" center-crops to
+// exactly Width x Height, "fit" keeps the aspect ratio within the box.
+type Rendition struct {
+	Name   string
+	Mode   string
+	Width  int
+	Height int
+}
+
+var DefaultRenditions = []Rendition{
+	{Name: "sq256", Mode: "fill", Width: 256, Height: 256},
+	{Name: "sq512", Mode: "fill", Width: 512, Height: 512},
+	{Name: "sq1024", Mode: "fill", Width: 1024, Height: 1024},
+	{Name: "fit640", Mode: "fit", Width: 640, Height: 640},
+	{Name: "fit1280", Mode: "fit", Width: 1280, Height: 1280},
+}
+
+// ParseRenditions reads a spec like "sq256:fill:256x256,fit1280:fit:1280x1280".
+func ParseRenditions(spec string) ([]Rendition, error) {
+	var renditions []Rendition
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid rendition %q", entry)
+		}
+		if parts[1] != "fill" && parts[1] != "fit" {
+			return nil, fmt.Errorf("invalid rendition mode %q", parts[1])
+		}
+		w, h, ok := strings.Cut(parts[2], "x")
+		width, werr := strconv.Atoi(w)
+		height, herr := strconv.Atoi(h)
+		if !ok || werr != nil || herr != nil || width <= 0 || height <= 0 {
+			return nil, fmt.Errorf("invalid rendition size %q", parts[2])
+		}
+		renditions = append(renditions, Rendition{
+			Name:   parts[0],
+			Mode:   parts[1],
+			Width:  width,
+			Height: height,
+		})
+	}
+	return renditions, nil
+}
+
+// RenditionKey is the storage key of one rendition of an image.
+func RenditionKey(imageID int64, name string) string {
+	return fmt.Sprintf("renditions/%d/%s.jpg", imageID, name)
+}
+
+// createRenditions stores every configured rendition of src, records them
+// in image_renditions and returns the key of the thumbnail. Renditions
+// that would need upscaling are skipped, the browser can do that just as
+// well; only the thumbnail is always made, every image needs one.
+func (p *ImageProcessor) createRenditions(job ImageJob, src image.Image) (string, error) {
+	ctx := context.Background()
+	bounds := src.Bounds()
+
+	var thumbKey string
+	for _, r := range p.cfg.Renditions {
+		var img image.Image
+		switch r.Mode {
+		case "fill":
+			if (bounds.Dx() < r.Width || bounds.Dy() < r.Height) && r.Name != p.cfg.Thumbnail {
+				continue
+			}
+			img = imaging.Fill(src, r.Width, r.Height, imaging.Center, imaging.Lanczos)
+		case "fit":
+			img = imaging.Fit(src, r.Width, r.Height, imaging.Lanczos)
+		}
+
+		var buf bytes.Buffer
+		if err := imaging.Encode(&buf, img, imaging.JPEG, imaging.JPEGQuality(80)); err != nil {
+			return "", fmt.Errorf("encode rendition %s: %w", r.Name, err)
+		}
+
+		key := RenditionKey(job.FileID, r.Name)
+		if err := p.store.Put(ctx, key, &buf, int64(buf.Len()), "image/jpeg"); err != nil {
+			return "", fmt.Errorf("save rendition %s: %w", r.Name, err)
+		}
+
+		_, err := p.db.Exec(ctx, `
+			INSERT INTO image_renditions (image_id, name, storage_key, width, height)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (image_id, name) DO UPDATE
+			SET storage_key = EXCLUDED.storage_key,
+			    width = EXCLUDED.width,
+			    height = EXCLUDED.height
+		`, job.FileID, r.Name, key, img.Bounds().Dx(), img.Bounds().Dy())
+		// a foreign key violation: the image was deleted meanwhile
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			return "", errImageGone
+		}
+		if err != nil {
+			return "", fmt.Errorf("record rendition %s: %w", r.Name, err)
+		}
+		if r.Name == p.cfg.Thumbnail {
+			thumbKey = key
+		}
+	}
+	if thumbKey == "" {
+		return "", fmt.Errorf("thumbnail rendition %q is not configured", p.cfg.Thumbnail)
+	}
+	return thumbKey, nil
+}
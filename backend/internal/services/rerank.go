@@ -0,0 +1,142 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"imageapp/internal/models"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// CrossEncoder scores documents against a query. Reranker is the
+// implementation.
+type CrossEncoder interface {
+	Score(query string, docs []string) ([]float64, error)
+}
+
+// Reranker scores query/document pairs with a cross-encoder. Unlike the
+// bi-encoder it sees both texts at once, which makes it more precise but
+// too slow for anything but a short list of candidates.
+type Reranker struct {
+	tokenizer *models.Tokenizer
+	session   *ort.DynamicAdvancedSession
+	maxTokens int
+	once      sync.Once
+}
+
+// NewReranker loads a cross-encoder with a single relevance logit, such as
+// ms-marco-MiniLM-L-6-v2. Pairs longer than maxTokens tokens are truncated.
+func NewReranker(modelPath, tokenizerPath string, maxTokens int) (*Reranker, error) {
+	if maxTokens < 8 {
+		return nil, fmt.Errorf("max tokens must be at least 8, got %d", maxTokens)
+	}
+	if err := acquireONNX(); err != nil {
+		return nil, err
+	}
+
+	tokenizer, err := models.NewTokenizer(tokenizerPath)
+	if err != nil {
+		releaseONNX()
+		return nil, fmt.Errorf("load tokenizer: %w", err)
+	}
+
+	session, err := ort.NewDynamicAdvancedSession(
+		modelPath,
+		[]string{"input_ids", "attention_mask", "token_type_ids"},
+		[]string{"logits"},
+		nil,
+	)
+	if err != nil {
+		tokenizer.Close()
+		releaseONNX()
+		return nil, fmt.Errorf("create session: %w", err)
+	}
+
+	return &Reranker{
+		tokenizer: tokenizer,
+		session:   session,
+		maxTokens: maxTokens,
+	}, nil
+}
+
+// Score returns the relevance of every document for query, between 0 and 1,
+// in the order of docs. All pairs run as one batch.
+func (r *Reranker) Score(query string, docs []string) ([]float64, error) {
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	n := len(docs)
+
+	pairs := make([][]int64, n)
+	types := make([][]int64, n)
+	seqLen := 0
+	for i, doc := range docs {
+		ids, typeIDs, _, err := r.tokenizer.TokenizePair(query, doc, r.maxTokens)
+		if err != nil {
+			return nil, fmt.Errorf("tokenize: %w", err)
+		}
+		pairs[i], types[i] = ids, typeIDs
+		seqLen = max(seqLen, len(ids))
+	}
+
+	inputIDs := make([]int64, n*seqLen)
+	attentionMask := make([]int64, n*seqLen)
+	tokenTypes := make([]int64, n*seqLen)
+	for i := range pairs {
+		copy(inputIDs[i*seqLen:], pairs[i])
+		copy(tokenTypes[i*seqLen:], types[i])
+		for j := range pairs[i] {
+			attentionMask[i*seqLen+j] = 1
+		}
+	}
+
+	shape := ort.NewShape(int64(n), int64(seqLen))
+	inputTensor, err := ort.NewTensor(shape, inputIDs)
+	if err != nil {
+		return nil, fmt.Errorf("create input tensor: %w", err)
+	}
+	defer inputTensor.Destroy()
+
+	maskTensor, err := ort.NewTensor(shape, attentionMask)
+	if err != nil {
+		return nil, fmt.Errorf("create attention tensor: %w", err)
+	}
+	defer maskTensor.Destroy()
+
+	tokenTypeTensor, err := ort.NewTensor(shape, tokenTypes)
+	if err != nil {
+		return nil, fmt.Errorf("create token type tensor: %w", err)
+	}
+	defer tokenTypeTensor.Destroy()
+
+	output, err := ort.NewEmptyTensor[float32](ort.NewShape(int64(n), 1))
+	if err != nil {
+		return nil, fmt.Errorf("create output tensor: %w", err)
+	}
+	defer output.Destroy()
+
+	// onnxruntime sessions may run concurrently
+	err = r.session.Run(
+		[]ort.Value{inputTensor, maskTensor, tokenTypeTensor},
+		[]ort.Value{output},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("inference: %w", err)
+	}
+
+	scores := make([]float64, n)
+	for i, logit := range output.GetData() {
+		scores[i] = 1 / (1 + math.Exp(-float64(logit)))
+	}
+	return scores, nil
+}
+
+func (r *Reranker) Close() {
+	r.once.Do(func() {
+		r.session.Destroy()
+		r.tokenizer.Close()
+		releaseONNX()
+	})
+}
@@ -0,0 +1,360 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrUnstrippable is returned by StripLocation for content it cannot
+// parse. Such files must not be served: whatever part could not be read
+// may carry the location.
+var ErrUnstrippable = errors.New("cannot strip location")
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	gifXMPApp  = []byte("XMP DataXMP")
+)
+
+// StrippedKey is the storage key of the location-stripped copy of the
+// blob key.
+func StrippedKey(key string) string {
+	return "stripped/" + key
+}
+
+// StripLocation returns a copy of an image without location data. JPEG
+// keeps its EXIF block with the GPS IFD blanked in place, so orientation
+// and the other tags survive; XMP and other metadata that may repeat the
+// location is dropped. PNG loses its eXIf and text chunks, WebP its EXIF
+// and XMP chunks, GIF its XMP extension. Anything that does not parse
+// completely fails with ErrUnstrippable.
+func StripLocation(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return stripJPEG(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return stripPNG(data)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return stripWebP(data)
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return stripGIF(data)
+	}
+	return nil, fmt.Errorf("%w: unknown format", ErrUnstrippable)
+}
+
+// stripJPEG walks every marker up to EOI, including the ones between the
+// scans of progressive JPEGs. Trailing bytes after EOI are dropped.
+func stripJPEG(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+
+	pos := 2
+	for {
+		if pos >= len(data) || data[pos] != 0xFF {
+			return nil, fmt.Errorf("%w: jpeg: no marker at %d", ErrUnstrippable, pos)
+		}
+		// a marker may be preceded by any number of 0xFF fill bytes
+		for pos < len(data) && data[pos] == 0xFF {
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, fmt.Errorf("%w: jpeg: truncated", ErrUnstrippable)
+		}
+		marker := data[pos]
+		pos++
+
+		switch {
+		case marker == 0xD9:
+			return append(out, 0xFF, 0xD9), nil
+		case marker == 0x01 || marker >= 0xD0 && marker <= 0xD7:
+			// standalone markers have no length
+			out = append(out, 0xFF, marker)
+			continue
+		case marker == 0x00 || marker == 0xD8:
+			return nil, fmt.Errorf("%w: jpeg: unexpected marker %#x", ErrUnstrippable, marker)
+		}
+
+		if pos+2 > len(data) {
+			return nil, fmt.Errorf("%w: jpeg: truncated", ErrUnstrippable)
+		}
+		length := int(binary.BigEndian.Uint16(data[pos:]))
+		end := pos + length
+		if length < 2 || end > len(data) {
+			return nil, fmt.Errorf("%w: jpeg: segment %#x runs past the end", ErrUnstrippable, marker)
+		}
+		payload := data[pos+2 : end]
+
+		switch marker {
+		case 0xE1:
+			// EXIF is kept without GPS; XMP, extended XMP and anything
+			// else in APP1 is dropped
+			if !bytes.HasPrefix(payload, exifHeader) {
+				pos = end
+				continue
+			}
+			segment := bytes.Clone(data[pos:end])
+			if err := blankGPS(segment[2+len(exifHeader):]); err != nil {
+				// cannot tell where the GPS tags are, so drop all of EXIF
+				pos = end
+				continue
+			}
+			out = append(out, 0xFF, marker)
+			out = append(out, segment...)
+		case 0xED:
+			// Photoshop/IPTC, which has fields for place names
+			pos = end
+			continue
+		default:
+			out = append(out, 0xFF, marker)
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+
+		if marker == 0xDA {
+			// entropy-coded data runs until the next marker that is not
+			// a stuffed 0xFF00 or a restart marker
+			scan := pos
+			for {
+				if scan+1 >= len(data) {
+					return nil, fmt.Errorf("%w: jpeg: truncated scan", ErrUnstrippable)
+				}
+				if data[scan] == 0xFF {
+					next := data[scan+1]
+					if next != 0x00 && next != 0xFF && (next < 0xD0 || next > 0xD7) {
+						break
+					}
+					if next != 0xFF {
+						scan++
+					}
+				}
+				scan++
+			}
+			out = append(out, data[pos:scan]...)
+			pos = scan
+		}
+	}
+}
+
+// pngDropped are the chunks that can carry the location: EXIF and text,
+// which includes XMP (iTXt "XML:com.adobe.xmp").
+var pngDropped = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true}
+
+// stripPNG copies the chunks up to IEND; the CRCs of kept chunks stay
+// valid because they are copied unchanged.
+func stripPNG(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:8]...)
+
+	pos := 8
+	for {
+		if pos+8 > len(data) {
+			return nil, fmt.Errorf("%w: png: truncated", ErrUnstrippable)
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		end := pos + 12 + length
+		if length < 0 || end > len(data) || end < pos {
+			return nil, fmt.Errorf("%w: png: chunk %q runs past the end", ErrUnstrippable, typ)
+		}
+		if !pngDropped[typ] {
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+		if typ == "IEND" {
+			return out, nil
+		}
+	}
+}
+
+// VP8X flags announcing EXIF and XMP chunks.
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// stripWebP drops the EXIF and XMP chunks, clears their VP8X flags and
+// fixes the RIFF size.
+func stripWebP(data []byte) ([]byte, error) {
+	size := int(binary.LittleEndian.Uint32(data[4:]))
+	if size < 4 || size+8 > len(data) {
+		return nil, fmt.Errorf("%w: webp: bad RIFF size", ErrUnstrippable)
+	}
+	data = data[:size+8]
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:12]...)
+
+	pos := 12
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, fmt.Errorf("%w: webp: truncated", ErrUnstrippable)
+		}
+		fourcc := string(data[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + length + length%2
+		if end > len(data) || end < pos {
+			return nil, fmt.Errorf("%w: webp: chunk %q runs past the end", ErrUnstrippable, fourcc)
+		}
+
+		switch fourcc {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			if length < 1 {
+				return nil, fmt.Errorf("%w: webp: short VP8X chunk", ErrUnstrippable)
+			}
+			start := len(out)
+			out = append(out, data[pos:end]...)
+			out[start+8] &^= webpFlagEXIF | webpFlagXMP
+		default:
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+// stripGIF walks the blocks up to the trailer and drops XMP application
+// extensions.
+func stripGIF(data []byte) ([]byte, error) {
+	truncated := fmt.Errorf("%w: gif: truncated", ErrUnstrippable)
+	if len(data) < 13 {
+		return nil, truncated
+	}
+	out := make([]byte, 0, len(data))
+
+	pos := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+	if pos > len(data) {
+		return nil, truncated
+	}
+	out = append(out, data[:pos]...)
+
+	// subBlocks returns the end of the data sub-blocks starting at p
+	subBlocks := func(p int) (int, error) {
+		for {
+			if p >= len(data) {
+				return 0, truncated
+			}
+			n := int(data[p])
+			p += 1 + n
+			if n == 0 {
+				return p, nil
+			}
+		}
+	}
+
+	for {
+		if pos >= len(data) {
+			return nil, truncated
+		}
+		start := pos
+		switch data[pos] {
+		case 0x3B:
+			return append(out, 0x3B), nil
+		case 0x21:
+			if pos+2 >= len(data) {
+				return nil, truncated
+			}
+			label := data[pos+1]
+			end, err := subBlocks(pos + 2)
+			if err != nil {
+				return nil, err
+			}
+			pos = end
+			// an application extension starts with an 11-byte identifier
+			isXMP := label == 0xFF && data[start+2] == 11 &&
+				start+3+11 <= len(data) && bytes.Equal(data[start+3:start+14], gifXMPApp)
+			if isXMP {
+				continue
+			}
+		case 0x2C:
+			if pos+10 > len(data) {
+				return nil, truncated
+			}
+			pos += 10
+			if flags := data[pos-1]; flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			// LZW minimum code size, then the image data
+			end, err := subBlocks(pos + 1)
+			if err != nil {
+				return nil, err
+			}
+			pos = end
+		default:
+			return nil, fmt.Errorf("%w: gif: unknown block %#x", ErrUnstrippable, data[pos])
+		}
+		out = append(out, data[start:pos]...)
+	}
+}
+
+// exifTypeSizes maps TIFF field types to their size in bytes.
+var exifTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// blankGPS zeroes the GPS IFD of a TIFF structure, including out-of-line
+// values, and sets its entry count to 0. It fails if the structure does
+// not parse far enough to be sure no GPS tag is left.
+func blankGPS(tiff []byte) error {
+	malformed := errors.New("malformed TIFF")
+	if len(tiff) < 8 {
+		return malformed
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return malformed
+	}
+
+	ifd0 := int(order.Uint32(tiff[4:]))
+	if ifd0 < 0 || ifd0+2 > len(tiff) {
+		return malformed
+	}
+
+	var gpsIFD int
+	n := int(order.Uint16(tiff[ifd0:]))
+	for i := 0; i < n; i++ {
+		entry := ifd0 + 2 + i*12
+		if entry+12 > len(tiff) {
+			return malformed
+		}
+		if order.Uint16(tiff[entry:]) == 0x8825 {
+			gpsIFD = int(order.Uint32(tiff[entry+8:]))
+			if gpsIFD <= 0 || gpsIFD+2 > len(tiff) {
+				return malformed
+			}
+		}
+	}
+	if gpsIFD == 0 {
+		return nil
+	}
+
+	n = int(order.Uint16(tiff[gpsIFD:]))
+	for i := 0; i < n; i++ {
+		entry := gpsIFD + 2 + i*12
+		if entry+12 > len(tiff) {
+			return malformed
+		}
+		size := exifTypeSizes[order.Uint16(tiff[entry+2:])] * int(order.Uint32(tiff[entry+4:]))
+		if size > 4 {
+			off := int(order.Uint32(tiff[entry+8:]))
+			if off < 0 || size < 0 || off+size > len(tiff) {
+				return malformed
+			}
+			clear(tiff[off : off+size])
+		}
+		clear(tiff[entry : entry+12])
+	}
+	clear(tiff[gpsIFD : gpsIFD+2])
+	return nil
+}
@@ -0,0 +1,254 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+const testXMP = "<x:xmpmeta><exif:GPSLatitude>37,48.5N</exif:GPSLatitude></x:xmpmeta>"
+
+func testImage() image.Image {
+	img := image.NewPaletted(image.Rect(0, 0, 16, 16), color.Palette{color.Black, color.White})
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i % 2)
+	}
+	return img
+}
+
+// gpsTIFF is a little-endian TIFF whose IFD0 points to a GPS IFD holding a
+// latitude (three rationals, stored out of line).
+func gpsTIFF() []byte {
+	le := binary.LittleEndian
+	b := []byte("II*\x00")
+	b = le.AppendUint32(b, 8)
+	// IFD0: one entry, the GPS IFD pointer
+	b = le.AppendUint16(b, 1)
+	b = le.AppendUint16(b, 0x8825)
+	b = le.AppendUint16(b, 4)
+	b = le.AppendUint32(b, 1)
+	b = le.AppendUint32(b, 26)
+	b = le.AppendUint32(b, 0)
+	// GPS IFD at 26: GPSLatitudeRef "N", GPSLatitude at 56
+	b = le.AppendUint16(b, 2)
+	b = le.AppendUint16(b, 1)
+	b = le.AppendUint16(b, 2)
+	b = le.AppendUint32(b, 2)
+	b = append(b, 'N', 0, 0, 0)
+	b = le.AppendUint16(b, 2)
+	b = le.AppendUint16(b, 5)
+	b = le.AppendUint32(b, 3)
+	b = le.AppendUint32(b, 56)
+	b = le.AppendUint32(b, 0)
+	for _, v := range []uint32{37, 1, 48, 1, 30, 1} {
+		b = le.AppendUint32(b, v)
+	}
+	return b
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	seg := []byte{0xFF, marker}
+	seg = binary.BigEndian.AppendUint16(seg, uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// testJPEG is a JPEG with an EXIF block carrying GPS, an XMP packet, fill
+// bytes before a marker and data after EOI.
+func testJPEG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	enc := buf.Bytes()
+
+	var b []byte
+	b = append(b, 0xFF, 0xD8)
+	b = append(b, jpegSegment(0xE1, append(bytes.Clone(exifHeader), gpsTIFF()...))...)
+	b = append(b, jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00"+testXMP))...)
+	b = append(b, 0xFF, 0xFF, 0xFF)
+	b = append(b, enc[2:]...)
+	return append(b, []byte("trailing "+testXMP)...)
+}
+
+func TestStripLocationJPEG(t *testing.T) {
+	data := testJPEG(t)
+	if x, err := exif.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatalf("test image has no EXIF: %v", err)
+	} else if _, err := x.Get(exif.GPSLatitude); err != nil {
+		t.Fatalf("test image has no GPS: %v", err)
+	}
+
+	out, err := StripLocation(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte(testXMP)) {
+		t.Error("XMP survived")
+	}
+	x, err := exif.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("EXIF block dropped: %v", err)
+	}
+	if _, err := x.Get(exif.GPSLatitude); err == nil {
+		t.Error("GPS latitude survived")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped JPEG does not decode: %v", err)
+	}
+}
+
+func TestStripLocationJPEGMalformed(t *testing.T) {
+	data := testJPEG(t)
+
+	// a segment length past the end
+	bad := bytes.Clone(data[:40])
+	if _, err := StripLocation(bad); !errors.Is(err, ErrUnstrippable) {
+		t.Errorf("truncated JPEG: got %v, want ErrUnstrippable", err)
+	}
+
+	// no EOI
+	eoi := bytes.LastIndex(data, []byte{0xFF, 0xD9})
+	if _, err := StripLocation(data[:eoi]); !errors.Is(err, ErrUnstrippable) {
+		t.Errorf("JPEG without EOI: got %v, want ErrUnstrippable", err)
+	}
+
+	// EXIF whose GPS pointer is out of range is dropped as a whole
+	tiff := gpsTIFF()
+	binary.LittleEndian.PutUint32(tiff[18:], 5000)
+	var b []byte
+	b = append(b, 0xFF, 0xD8)
+	b = append(b, jpegSegment(0xE1, append(bytes.Clone(exifHeader), tiff...))...)
+	b = append(b, data[bytes.Index(data, []byte{0xFF, 0xDB}):]...)
+	out, err := StripLocation(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, exifHeader) {
+		t.Error("malformed EXIF block kept")
+	}
+}
+
+func pngChunk(typ string, payload []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	b = append(b, typ...)
+	b = append(b, payload...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+}
+
+func TestStripLocationPNG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	enc := buf.Bytes()
+	ihdrEnd := 8 + 12 + 13
+
+	var b []byte
+	b = append(b, enc[:ihdrEnd]...)
+	b = append(b, pngChunk("eXIf", gpsTIFF())...)
+	b = append(b, pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"+testXMP))...)
+	b = append(b, enc[ihdrEnd:]...)
+
+	out, err := StripLocation(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("eXIf")) || bytes.Contains(out, []byte(testXMP)) {
+		t.Error("metadata chunks survived")
+	}
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped PNG does not decode: %v", err)
+	}
+
+	if _, err := StripLocation(b[:len(b)-12]); !errors.Is(err, ErrUnstrippable) {
+		t.Errorf("PNG without IEND: got %v, want ErrUnstrippable", err)
+	}
+}
+
+func webpChunk(fourcc string, payload []byte) []byte {
+	b := append([]byte(fourcc), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+	b = append(b, payload...)
+	if len(payload)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func TestStripLocationWebP(t *testing.T) {
+	vp8x := make([]byte, 10)
+	vp8x[0] = webpFlagEXIF | webpFlagXMP | 0x10 // 0x10: alpha, must survive
+
+	var body []byte
+	body = append(body, "WEBP"...)
+	body = append(body, webpChunk("VP8X", vp8x)...)
+	body = append(body, webpChunk("VP8L", []byte{0x2F, 1, 2, 3, 4})...)
+	body = append(body, webpChunk("EXIF", gpsTIFF())...)
+	body = append(body, webpChunk("XMP ", []byte(testXMP))...)
+	data := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	data = append(data, body...)
+
+	out, err := StripLocation(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("EXIF")) || bytes.Contains(out, []byte(testXMP)) {
+		t.Error("metadata chunks survived")
+	}
+	if flags := out[20]; flags != 0x10 {
+		t.Errorf("VP8X flags %#x, want 0x10", flags)
+	}
+	if size := binary.LittleEndian.Uint32(out[4:]); int(size) != len(out)-8 {
+		t.Errorf("RIFF size %d, want %d", size, len(out)-8)
+	}
+
+	if _, err := StripLocation(data[:len(data)-4]); !errors.Is(err, ErrUnstrippable) {
+		t.Errorf("truncated WebP: got %v, want ErrUnstrippable", err)
+	}
+}
+
+func TestStripLocationGIF(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	enc := buf.Bytes()
+	// header, screen descriptor and a 2-entry global color table
+	headerEnd := 13 + 6
+
+	ext := []byte{0x21, 0xFF, 11}
+	ext = append(ext, gifXMPApp...)
+	ext = append(ext, byte(len(testXMP)))
+	ext = append(ext, testXMP...)
+	ext = append(ext, 0)
+
+	var b []byte
+	b = append(b, enc[:headerEnd]...)
+	b = append(b, ext...)
+	b = append(b, enc[headerEnd:]...)
+
+	out, err := StripLocation(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte(testXMP)) {
+		t.Error("XMP survived")
+	}
+	if _, err := gif.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped GIF does not decode: %v", err)
+	}
+}
+
+func TestStripLocationUnknown(t *testing.T) {
+	if _, err := StripLocation([]byte("not an image")); !errors.Is(err, ErrUnstrippable) {
+		t.Errorf("got %v, want ErrUnstrippable", err)
+	}
+}
@@ -0,0 +1,73 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+
+	"github.com/disintegration/imaging"
+	_ "golang.org/x/image/webp" // registers the WebP decoder with package image
+)
+
+// ErrInvalidImage marks content that is not an acceptable image. It is a
+// permanent error: processing such a file again will not help.
+var ErrInvalidImage = errors.New("invalid image")
+
+const DefaultMaxPixels = 50_000_000
+
+// formatMimes maps image.DecodeConfig format names to their MIME type.
+var formatMimes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+}
+
+// SniffImage looks at the actual bytes instead of trusting names or
+// headers: the magic bytes must be an allowed image type, the header must
+// decode as that type, and the dimensions must stay below maxPixels so
+// decoding cannot allocate a huge bitmap. It returns the detected MIME type
+// and leaves r rewound.
+func SniffImage(r io.ReadSeeker, maxPixels int) (string, image.Config, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", image.Config{}, err
+	}
+	sniffed := http.DetectContentType(head[:n])
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", image.Config{}, err
+	}
+	cfg, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return "", cfg, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", cfg, err
+	}
+
+	mime, ok := formatMimes[format]
+	if !ok || mime != sniffed {
+		return "", cfg, fmt.Errorf("%w: unsupported format %s", ErrInvalidImage, sniffed)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > int64(maxPixels) {
+		return "", cfg, fmt.Errorf("%w: %dx%d exceeds %d pixels", ErrInvalidImage, cfg.Width, cfg.Height, maxPixels)
+	}
+	return mime, cfg, nil
+}
+
+// DecodeImage checks r with SniffImage and decodes it upright, applying
+// the EXIF orientation. Content that does not decode is ErrInvalidImage.
+func DecodeImage(r io.ReadSeeker, maxPixels int) (image.Image, error) {
+	if _, _, err := SniffImage(r, maxPixels); err != nil {
+		return nil, err
+	}
+	img, err := imaging.Decode(r, imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	return img, nil
+}
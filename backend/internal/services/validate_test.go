@@ -0,0 +1,112 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+)
+
+// pngHeader is a PNG that ends after its IHDR chunk, claiming w x h.
+func pngHeader(w, h uint32) []byte {
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, w)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, h)
+	ihdr = append(ihdr, 8, 2, 0, 0, 0)
+	b := []byte("\x89PNG\r\n\x1a\n")
+	b = binary.BigEndian.AppendUint32(b, 13)
+	b = append(b, ihdr...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(ihdr))
+}
+
+// jpegHeader is a JFIF JPEG that ends after its frame header, claiming
+// w x h.
+func jpegHeader(w, h uint16) []byte {
+	b := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10}
+	b = append(b, "JFIF\x00"...)
+	b = append(b, 1, 1, 0, 0, 1, 0, 1, 0, 0)
+	b = append(b, 0xFF, 0xC0, 0x00, 0x11, 8)
+	b = binary.BigEndian.AppendUint16(b, h)
+	b = binary.BigEndian.AppendUint16(b, w)
+	return append(b, 3, 1, 0x11, 0, 2, 0x11, 0, 3, 0x11, 0)
+}
+
+// gifHeader is a GIF that ends after its screen descriptor, claiming w x h.
+func gifHeader(w, h uint16) []byte {
+	b := []byte("GIF89a")
+	b = binary.LittleEndian.AppendUint16(b, w)
+	b = binary.LittleEndian.AppendUint16(b, h)
+	return append(b, 0, 0, 0)
+}
+
+func encoded(t *testing.T, encode func(io.Writer) error) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSniffImage(t *testing.T) {
+	img := testImage()
+	tests := []struct {
+		name    string
+		data    []byte
+		mime    string // empty if it must be rejected
+		wantErr string
+	}{
+		{"png", encoded(t, func(w io.Writer) error { return png.Encode(w, img) }), "image/png", ""},
+		{"jpeg", encoded(t, func(w io.Writer) error { return jpeg.Encode(w, img, nil) }), "image/jpeg", ""},
+		{"gif", encoded(t, func(w io.Writer) error { return gif.Encode(w, img, nil) }), "image/gif", ""},
+		{"png header within the limit", pngHeader(1000, 1000), "image/png", ""},
+		{"empty", nil, "", ""},
+		{"text", []byte("hello, this is not an image"), "", ""},
+		{"html", []byte("<!DOCTYPE html><html><body><img src=x></body></html>"), "", ""},
+		{"png magic only", []byte("\x89PNG\r\n\x1a\n"), "", ""},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="1" height="1"></svg>`), "", ""},
+		{"bmp", append([]byte("BM"), make([]byte, 60)...), "", ""},
+		{"png pixel bomb", pngHeader(100_000, 100_000), "", "exceeds"},
+		{"png too wide", pngHeader(DefaultMaxPixels+1, 1), "", "exceeds"},
+		{"jpeg pixel bomb", jpegHeader(65_535, 65_535), "", "exceeds"},
+		{"gif pixel bomb", gifHeader(65_535, 65_535), "", "exceeds"},
+		{"png without pixels", pngHeader(0, 10), "", ""},
+	}
+	for _, tt := range tests {
+		r := bytes.NewReader(tt.data)
+		mime, _, err := SniffImage(r, DefaultMaxPixels)
+		if tt.mime != "" {
+			if err != nil || mime != tt.mime {
+				t.Errorf("%s: got %q, %v, want %s", tt.name, mime, err, tt.mime)
+			}
+			if pos, _ := r.Seek(0, io.SeekCurrent); pos != 0 {
+				t.Errorf("%s: reader left at %d, want rewound", tt.name, pos)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrInvalidImage) {
+			t.Errorf("%s: got %q, %v, want ErrInvalidImage", tt.name, mime, err)
+			continue
+		}
+		if tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error %q, want it to mention %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDecodeImageRejectsBombBeforeDecoding(t *testing.T) {
+	// a valid but large PNG is refused for its header alone
+	data := encoded(t, func(w io.Writer) error { return png.Encode(w, testImage()) })
+	if _, err := DecodeImage(bytes.NewReader(data), 16*16-1); !errors.Is(err, ErrInvalidImage) || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("got %v, want the pixel limit error", err)
+	}
+	if _, err := DecodeImage(bytes.NewReader(data), 16*16); err != nil {
+		t.Errorf("image at the limit: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+type Info struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// Storage keeps original images and thumbnails as blobs addressed by key,
+// e.g. "1712345_cat.png" or "thumbnails/thumb_1.jpg".
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (Info, error)
+	// URL is the address clients use to download the blob.
+	URL(key string) string
+}
+
+// FileMover is implemented by backends that can take over a local file
+// without copying it, e.g. by renaming it into place.
+type FileMover interface {
+	MoveFile(ctx context.Context, key, path, contentType string) error
+}
+
+// PutFile stores the file at path under key. Backends implementing
+// FileMover take the file over, others get it streamed from disk; either
+// way the caller may remove path afterwards.
+func PutFile(ctx context.Context, s Storage, key, path, contentType string) error {
+	if m, ok := s.(FileMover); ok {
+		return m.MoveFile(ctx, key, path, contentType)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", path, err)
+	}
+	return s.Put(ctx, key, f, fi.Size(), contentType)
+}
@@ -0,0 +1,89 @@
+// Package testdb gives tests a migrated schema of their own in the
+// database named by TEST_DATABASE_URL. Tests that need one are skipped
+// when it is not set.
+package testdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"imageapp/internal/services"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var schemas atomic.Int64
+
+// New creates a schema, migrates it and returns a pool whose search_path
+// starts with it. The schema is dropped when the test ends. The vector
+// extension is created in public, so the database user needs to be
+// allowed to do that unless it already exists.
+func New(t testing.TB) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	schema := fmt.Sprintf("test_%d_%d", os.Getpid(), schemas.Add(1))
+
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	_, err = conn.Exec(ctx, `CREATE EXTENSION IF NOT EXISTS vector SCHEMA public`)
+	if err == nil {
+		_, err = conn.Exec(ctx, "CREATE SCHEMA "+schema)
+	}
+	conn.Close(ctx)
+	if err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		conn, err := pgx.Connect(ctx, url)
+		if err != nil {
+			t.Errorf("connect: %v", err)
+			return
+		}
+		defer conn.Close(ctx)
+		if _, err := conn.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+			t.Errorf("drop schema: %v", err)
+		}
+	})
+
+	cfg, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatalf("parse TEST_DATABASE_URL: %v", err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema + ", public"
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	// registered after the drop, so it runs first
+	t.Cleanup(pool.Close)
+
+	if err := services.Migrate(ctx, pool); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return pool
+}
+
+// Models registers embedder as the active text model in db.
+func Models(t testing.TB, db services.DB, embedder services.Embedder) *services.ModelSet {
+	t.Helper()
+	composer, err := services.NewTextComposer("tags", 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	models, err := services.NewModelSet(context.Background(), db,
+		services.EmbeddingModel{Name: "fake", Embedder: embedder}, nil, composer)
+	if err != nil {
+		t.Fatalf("embedding models: %v", err)
+	}
+	return models
+}
@@ -3,6 +3,16 @@ import type { ImageItem } from "../types";
 
 type Props = { items: ImageItem[] };
 
+// Only the square crops are offered: they all show the same part of the
+// image, while a fitted rendition would make the card's crop change with
+// the screen width.
+function srcSet(it: ImageItem): string | undefined {
+  if (!it.renditions) return undefined;
+  const squares = Object.values(it.renditions).filter(r => r.width === r.height);
+  if (squares.length === 0) return undefined;
+  return squares.map(r => `${r.url} ${r.width}w`).join(", ");
+}
+
 export default function Feed({ items }: Props): JSX.Element {
   if (items.length === 0) {
     return (
@@ -21,6 +31,8 @@ export default function Feed({ items }: Props): JSX.Element {
         >
           <img
             src={it.thumbnail_url}
+            srcSet={srcSet(it)}
+            sizes="(min-width: 1024px) 33vw, (min-width: 640px) 50vw, 100vw"
             alt={it.title}
             className="w-full h-48 object-cover"
             loading="lazy"
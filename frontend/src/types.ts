@@ -1,9 +1,16 @@
+export interface Rendition {
+  url: string;
+  width: number;
+  height: number;
+}
+
 export interface ImageItem {
   id: number;
   title: string;
   tags: string[];
   image_url: string;
   thumbnail_url: string;
+  renditions?: Record<string, Rendition>;
   created_at: string;
   score?: number;
 }